@@ -0,0 +1,211 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Diff returns the events turning the files in old into the ones in curr,
+// both keyed by path, as a poll with the default options reports them.
+// Event.Time and Event.Seq are left zero.
+func Diff(old, curr map[string]os.FileInfo) []Event {
+	return differ{}.diff(old, curr)
+}
+
+// differ compares two listings of the watched files.
+type differ struct {
+	now             time.Time
+	ownership       bool                                     // see WithOwnershipTracking
+	caseInsensitive bool                                     // see WithCaseInsensitive
+	ignoreModTime   bool                                     // see WithIgnoreModTime
+	fingerprints    bool                                     // see WithFingerprintMoves
+	isAppend        func(fp string, latest os.FileInfo) bool // see WithAppendDetection
+	comparator      func(old, curr os.FileInfo) Op           // see WithComparator
+}
+
+func (d differ) diff(old, curr map[string]os.FileInfo) []Event {
+	created := make(map[string]os.FileInfo)
+	removed := make(map[string]os.FileInfo)
+
+	// one event per path, with the ops detected for it OR'ed together
+	var events []*Event
+	byPath := make(map[string]*Event)
+	addOp := func(fp string, op Op, fi os.FileInfo) *Event {
+		ev, ok := byPath[fp]
+		if !ok {
+			ev = &Event{Path: fp, FileInfo: fi, Time: d.now}
+			byPath[fp] = ev
+			events = append(events, ev)
+		}
+		ev.Op |= op
+		return ev
+	}
+
+	for latestFp, latestFi := range old {
+		// 1. if not found in curr -> removed
+		if _, ok := curr[latestFp]; !ok {
+			removed[latestFp] = latestFi
+		}
+	}
+
+	// paths by their lowercase, see WithCaseInsensitive
+	var folded map[string]string
+	if d.caseInsensitive {
+		folded = make(map[string]string, len(old))
+		for fp := range old {
+			folded[strings.ToLower(fp)] = fp
+		}
+	}
+
+	swapped := swaps(old, curr)
+	for fp, currFi := range curr {
+		latestFi, ok := old[fp]
+		if !ok {
+			// 2. if not found in old -> created, unless only the
+			// case changed -> rename
+			if latestFp, ok := folded[strings.ToLower(fp)]; ok {
+				if _, ok := removed[latestFp]; ok {
+					delete(removed, latestFp)
+					addOp(latestFp, Rename, currFi).NewPath = fp
+					continue
+				}
+			}
+			created[fp] = currFi
+			continue
+		}
+		if latestFi == nil || currFi == nil {
+			continue // nothing to compare against
+		}
+		// 2b. if the file swapped places with another -> rename both
+		if otherFp, ok := swapped[fp]; ok {
+			op := Move
+			if filepath.Dir(fp) == filepath.Dir(otherFp) {
+				op = Rename
+			}
+			addOp(fp, op, curr[otherFp]).NewPath = otherFp
+			continue
+		}
+		// 3. if the type changes (e.g. file <-> directory) -> remove the old
+		// and create the new one, with a single event
+		if latestFi.Mode().Type() != currFi.Mode().Type() {
+			addOp(fp, Remove|Create, currFi)
+			continue
+		}
+		// 4-5b. otherwise compare the contents and attributes
+		var op Op
+		if d.comparator != nil {
+			op = d.comparator(unwrapFileInfo(latestFi), unwrapFileInfo(currFi))
+		} else {
+			op = d.compare(fp, latestFi, currFi)
+		}
+		if op != 0 {
+			addOp(fp, op, currFi)
+		}
+	}
+
+	// sorted so the pairing below doesn't depend on map order when several
+	// candidates are the same file, e.g. hard links
+	removedFps, createdFps := sortedKeys(removed), sortedKeys(created)
+	for _, removeFp := range removedFps {
+		for _, createFp := range createdFps {
+			createFi, ok := created[createFp]
+			if !ok {
+				continue // already paired
+			}
+			// 6. if removed file becomes created file, or a copy of it
+			// -> move
+			if sameFile(removed[removeFp], createFi) ||
+				d.fingerprints && sameContent(removed[removeFp], createFi) {
+				op := Move
+				if filepath.Dir(removeFp) == filepath.Dir(createFp) {
+					op = Rename
+				}
+				addOp(removeFp, op, removed[removeFp]).NewPath = createFp
+				delete(removed, removeFp)
+				delete(created, createFp)
+				break
+			}
+		}
+	}
+
+	for _, fp := range createdFps {
+		if fi, ok := created[fp]; ok {
+			addOp(fp, Create, fi)
+		}
+	}
+	for _, fp := range removedFps {
+		if fi, ok := removed[fp]; ok {
+			addOp(fp, Remove, fi)
+		}
+	}
+
+	result := make([]Event, len(events))
+	for i, ev := range events {
+		result[i] = *ev
+	}
+	return result
+}
+
+// compare returns the ops turning latestFi into currFi at fp, unless a
+// comparator is set, see WithComparator.
+func (d differ) compare(fp string, latestFi, currFi os.FileInfo) Op {
+	var op Op
+	// 4. if content (or ModTime + Size) changes -> modify, or truncate if
+	// it shrank, or append if it only grew
+	if isModified(latestFi, currFi, d.ignoreModTime) {
+		switch {
+		case currFi.Size() < latestFi.Size():
+			op |= Truncate
+		case d.isAppend != nil && currFi.Size() > latestFi.Size() && d.isAppend(fp, latestFi):
+			op |= Append
+		default:
+			op |= Modify
+		}
+	}
+	// 5. if mode changes -> chmod
+	if latestFi.Mode() != currFi.Mode() {
+		op |= Chmod
+	}
+	// 5b. if the owner or group changes -> chown
+	if d.ownership && ownerChanged(latestFi, currFi) {
+		op |= Chown
+	}
+	return op
+}
+
+// swaps returns the paths whose files traded places between old and curr,
+// e.g. a and b renamed to each other, both ways. Only files with a file ID
+// are considered.
+func swaps(old, curr map[string]os.FileInfo) map[string]string {
+	// paths by the ID of the file that was there, when another is now
+	byID := make(map[fileID]string)
+	for fp, currFi := range curr {
+		f1, ok1 := old[fp].(*fileInfo)
+		f2, ok2 := currFi.(*fileInfo)
+		if ok1 && ok2 && f1.hasID && f2.hasID && f1.id != f2.id {
+			byID[f1.id] = fp
+		}
+	}
+
+	swapped := make(map[string]string)
+	for latestID, fp := range byID {
+		// the file now at fp was at otherFp, which now has the one from fp
+		otherFp, ok := byID[curr[fp].(*fileInfo).id]
+		if ok && otherFp != fp && curr[otherFp].(*fileInfo).id == latestID {
+			swapped[fp] = otherFp
+		}
+	}
+	return swapped
+}
+
+func sortedKeys(m map[string]os.FileInfo) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	modTime := time.Now()
+	info := func(data string, mode fs.FileMode, modTime time.Time) os.FileInfo {
+		fsys := fstest.MapFS{"f": {Data: []byte(data), Mode: mode, ModTime: modTime}}
+		fi, err := fsys.Stat("f")
+		require.NoError(t, err)
+		return fi
+	}
+	withID := func(fi os.FileInfo, ino uint64) os.FileInfo {
+		return &fileInfo{FileInfo: fi, id: fileID{dev: 1, ino: ino}, hasID: true}
+	}
+	file := info("hello", 0644, modTime)
+
+	for _, tt := range []struct {
+		name string
+		old  map[string]os.FileInfo
+		curr map[string]os.FileInfo
+		want []Event
+	}{
+		{
+			name: "unchanged",
+			old:  map[string]os.FileInfo{"a/xxx": file},
+			curr: map[string]os.FileInfo{"a/xxx": file},
+		},
+		{
+			name: "create",
+			curr: map[string]os.FileInfo{"a/xxx": file},
+			want: []Event{{Path: "a/xxx", Op: Create}},
+		},
+		{
+			name: "remove",
+			old:  map[string]os.FileInfo{"a/xxx": file},
+			want: []Event{{Path: "a/xxx", Op: Remove}},
+		},
+		{
+			name: "modify",
+			old:  map[string]os.FileInfo{"a/xxx": file},
+			curr: map[string]os.FileInfo{"a/xxx": info("world", 0644, modTime.Add(time.Second))},
+			want: []Event{{Path: "a/xxx", Op: Modify}},
+		},
+		{
+			name: "truncate",
+			old:  map[string]os.FileInfo{"a/xxx": file},
+			curr: map[string]os.FileInfo{"a/xxx": info("", 0644, modTime.Add(time.Second))},
+			want: []Event{{Path: "a/xxx", Op: Truncate}},
+		},
+		{
+			name: "chmod",
+			old:  map[string]os.FileInfo{"a/xxx": file},
+			curr: map[string]os.FileInfo{"a/xxx": info("hello", 0600, modTime)},
+			want: []Event{{Path: "a/xxx", Op: Chmod}},
+		},
+		{
+			name: "type change",
+			old:  map[string]os.FileInfo{"a/xxx": file},
+			curr: map[string]os.FileInfo{"a/xxx": info("", fs.ModeDir|0755, modTime)},
+			want: []Event{{Path: "a/xxx", Op: Remove | Create}},
+		},
+		{
+			name: "rename",
+			old:  map[string]os.FileInfo{"a/xxx": withID(file, 1)},
+			curr: map[string]os.FileInfo{"a/yyy": withID(file, 1)},
+			want: []Event{{Path: "a/xxx", NewPath: "a/yyy", Op: Rename}},
+		},
+		{
+			name: "move",
+			old:  map[string]os.FileInfo{"a/xxx": withID(file, 1)},
+			curr: map[string]os.FileInfo{"b/yyy": withID(file, 1)},
+			want: []Event{{Path: "a/xxx", NewPath: "b/yyy", Op: Move}},
+		},
+		{
+			name: "move keeping its name without ids",
+			old:  map[string]os.FileInfo{"a/xxx": file},
+			curr: map[string]os.FileInfo{"b/xxx": file},
+			want: []Event{{Path: "a/xxx", NewPath: "b/xxx", Op: Move}},
+		},
+		{
+			name: "symlink re-pointed",
+			old:  map[string]os.FileInfo{"a/xxx": &fileInfo{FileInfo: file, target: "a/yyy"}},
+			curr: map[string]os.FileInfo{"a/xxx": &fileInfo{FileInfo: file, target: "a/zzz"}},
+			want: []Event{{Path: "a/xxx", Op: Modify}},
+		},
+		{
+			name: "two moves",
+			old:  map[string]os.FileInfo{"a/xxx": withID(file, 1), "a/yyy": withID(file, 2)},
+			curr: map[string]os.FileInfo{"b/yyy": withID(file, 2), "b/xxx": withID(file, 1)},
+			want: []Event{
+				{Path: "a/xxx", NewPath: "b/xxx", Op: Move},
+				{Path: "a/yyy", NewPath: "b/yyy", Op: Move},
+			},
+		},
+		{
+			name: "hard links moved",
+			old:  map[string]os.FileInfo{"a/xxx": withID(file, 1), "a/yyy": withID(file, 1)},
+			curr: map[string]os.FileInfo{"b/xxx": withID(file, 1), "b/yyy": withID(file, 1)},
+			want: []Event{
+				{Path: "a/xxx", NewPath: "b/xxx", Op: Move},
+				{Path: "a/yyy", NewPath: "b/yyy", Op: Move},
+			},
+		},
+		{
+			name: "remove and create of different files",
+			old:  map[string]os.FileInfo{"a/xxx": withID(file, 1)},
+			curr: map[string]os.FileInfo{"a/yyy": withID(file, 2)},
+			want: []Event{{Path: "a/yyy", Op: Create}, {Path: "a/xxx", Op: Remove}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			events := Diff(tt.old, tt.curr)
+			require.Len(t, events, len(tt.want))
+			for i, ev := range events {
+				require.Equal(t, tt.want[i].Path, ev.Path)
+				require.Equal(t, tt.want[i].NewPath, ev.NewPath)
+				require.Equal(t, tt.want[i].Op, ev.Op)
+			}
+		})
+	}
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Op uint32
@@ -14,12 +19,32 @@ const (
 	Rename
 	Chmod
 	Move
+	Truncate
+	Append
+	Chown
 )
 
 type Event struct {
 	FileInfo os.FileInfo
 	Path     string
+	NewPath  string // destination of a Rename or Move, empty otherwise
 	Op       Op
+	Time     time.Time // when the watcher detected the change
+	Seq      uint64    // increases by one per event emitted, dropped ones included
+}
+
+var allOps = []Op{Create, Remove, Modify, Rename, Chmod, Move, Truncate, Append, Chown}
+
+var opNames = map[string]Op{
+	"CREATE":   Create,
+	"REMOVE":   Remove,
+	"MODIFY":   Modify,
+	"RENAME":   Rename,
+	"CHMOD":    Chmod,
+	"MOVE":     Move,
+	"TRUNCATE": Truncate,
+	"APPEND":   Append,
+	"CHOWN":    Chown,
 }
 
 func (op Op) String() string {
@@ -42,14 +67,54 @@ func (op Op) String() string {
 	if op&Move == Move {
 		buffer.WriteString("|MOVE")
 	}
+	if op&Truncate == Truncate {
+		buffer.WriteString("|TRUNCATE")
+	}
+	if op&Append == Append {
+		buffer.WriteString("|APPEND")
+	}
+	if op&Chown == Chown {
+		buffer.WriteString("|CHOWN")
+	}
 	if buffer.Len() == 0 {
 		return ""
 	}
 	return buffer.String()[1:]
 }
 
-func (e *Event) IsDirEvent() bool {
+func (e *Event) String() string {
 	if e == nil {
+		return ""
+	}
+	s := e.Op.String() + " " + e.Path
+	if e.NewPath != "" {
+		s += " -> " + e.NewPath
+	}
+	if e.FileInfo != nil {
+		s += fmt.Sprintf(" (%d bytes, %s)", e.FileInfo.Size(), e.FileInfo.Mode())
+	}
+	return s
+}
+
+// Dir returns the directory Path is in.
+func (e *Event) Dir() string {
+	if e == nil || e.Path == "" {
+		return ""
+	}
+	return filepath.Dir(e.Path)
+}
+
+// NewDir returns the directory NewPath is in, "" unless the event is a
+// Move or Rename.
+func (e *Event) NewDir() string {
+	if e == nil || e.NewPath == "" {
+		return ""
+	}
+	return filepath.Dir(e.NewPath)
+}
+
+func (e *Event) IsDirEvent() bool {
+	if e == nil || e.FileInfo == nil {
 		return false
 	}
 	return e.FileInfo.IsDir()
@@ -66,3 +131,78 @@ func (e *Event) HasOps(ops ...Op) bool {
 	}
 	return false
 }
+
+// FileSummary is the part of os.FileInfo that survives JSON encoding, it
+// implements os.FileInfo for decoded events.
+type FileSummary struct {
+	FileName    string      `json:"name"`
+	FileSize    int64       `json:"size"`
+	FileMode    os.FileMode `json:"mode"`
+	FileModTime time.Time   `json:"modTime"`
+	Dir         bool        `json:"isDir"`
+}
+
+func (f *FileSummary) Name() string       { return f.FileName }
+func (f *FileSummary) Size() int64        { return f.FileSize }
+func (f *FileSummary) Mode() os.FileMode  { return f.FileMode }
+func (f *FileSummary) ModTime() time.Time { return f.FileModTime }
+func (f *FileSummary) IsDir() bool        { return f.Dir }
+func (f *FileSummary) Sys() any           { return nil }
+
+func summarize(fi os.FileInfo) *FileSummary {
+	return &FileSummary{
+		FileName:    fi.Name(),
+		FileSize:    fi.Size(),
+		FileMode:    fi.Mode(),
+		FileModTime: fi.ModTime(),
+		Dir:         fi.IsDir(),
+	}
+}
+
+type eventJSON struct {
+	Op      string       `json:"op"`
+	Path    string       `json:"path"`
+	NewPath string       `json:"newPath,omitempty"`
+	File    *FileSummary `json:"file,omitempty"`
+	Time    time.Time    `json:"time"`
+	Seq     uint64       `json:"seq"`
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	ej := eventJSON{
+		Op:      e.Op.String(),
+		Path:    e.Path,
+		NewPath: e.NewPath,
+		Time:    e.Time,
+		Seq:     e.Seq,
+	}
+	if e.FileInfo != nil {
+		ej.File = summarize(e.FileInfo)
+	}
+	return json.Marshal(ej)
+}
+
+// UnmarshalJSON decodes what MarshalJSON encodes, FileInfo becomes a *FileSummary.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var ej eventJSON
+	if err := json.Unmarshal(data, &ej); err != nil {
+		return err
+	}
+
+	var op Op
+	if ej.Op != "" {
+		for _, name := range strings.Split(ej.Op, "|") {
+			o, ok := opNames[name]
+			if !ok {
+				return fmt.Errorf("unknown op %s", name)
+			}
+			op |= o
+		}
+	}
+
+	*e = Event{Path: ej.Path, NewPath: ej.NewPath, Op: op, Time: ej.Time, Seq: ej.Seq}
+	if ej.File != nil {
+		e.FileInfo = ej.File
+	}
+	return nil
+}
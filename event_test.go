@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventString(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, []byte("hello"), 0644)
+	require.NoError(t, err)
+	fi, err := os.Stat(filePath)
+	require.NoError(t, err)
+
+	ev := &Event{Path: "/a/xxx", NewPath: "/a/yyy", Op: Rename, FileInfo: fi}
+	require.Equal(t, "RENAME /a/xxx -> /a/yyy (5 bytes, -rw-r--r--)", ev.String())
+
+	ev = &Event{Path: "/a", Op: Remove}
+	require.Equal(t, "REMOVE /a", ev.String())
+}
+
+func TestEventDir(t *testing.T) {
+	ev := &Event{Path: "/a/b/c.txt", Op: Create}
+	require.Equal(t, "/a/b", ev.Dir())
+	require.Equal(t, "", ev.NewDir())
+
+	ev = &Event{Path: "/a/b/c.txt", NewPath: "/d/c.txt", Op: Move}
+	require.Equal(t, "/a/b", ev.Dir())
+	require.Equal(t, "/d", ev.NewDir())
+}
+
+func TestEventNilFileInfo(t *testing.T) {
+	ev := &Event{Path: "/a", Op: Remove}
+	require.NotPanics(t, func() {
+		require.False(t, ev.IsDirEvent())
+		require.True(t, ev.HasOps(Remove))
+		require.Equal(t, "REMOVE /a", ev.String())
+	})
+}
+
+func TestEventJSON(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, []byte("hello"), 0644)
+	require.NoError(t, err)
+	fi, err := os.Stat(filePath)
+	require.NoError(t, err)
+
+	ev := Event{Path: filePath, Op: Modify, FileInfo: fi, Time: time.Now().UTC(), Seq: 7}
+	data, err := json.Marshal(ev)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"op":"MODIFY"`)
+	require.Contains(t, string(data), `"name":"xxx"`)
+
+	var decoded Event
+	err = json.Unmarshal(data, &decoded)
+	require.NoError(t, err)
+	require.Equal(t, ev.Path, decoded.Path)
+	require.Equal(t, ev.Op, decoded.Op)
+	require.Equal(t, ev.Seq, decoded.Seq)
+	require.True(t, ev.Time.Equal(decoded.Time))
+	require.Equal(t, fi.Size(), decoded.FileInfo.Size())
+	require.Equal(t, fi.Mode(), decoded.FileInfo.Mode())
+	require.True(t, fi.ModTime().Equal(decoded.FileInfo.ModTime()))
+	require.False(t, decoded.IsDirEvent())
+
+	err = json.Unmarshal([]byte(`{"op":"CREATE|CHMOD","path":"/a"}`), &decoded)
+	require.NoError(t, err)
+	require.Equal(t, Create|Chmod, decoded.Op)
+	require.Nil(t, decoded.FileInfo)
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileIDOf is unsupported, os.SameFile and a heuristic are used instead.
+func fileIDOf(os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// ownerOf is unsupported, ownership changes aren't detected.
+func ownerOf(os.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
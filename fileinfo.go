@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"os"
+)
+
+// fileInfo carries what is gathered while listing alongside os.FileInfo.
+type fileInfo struct {
+	os.FileInfo
+	hash   []byte // nil unless content hashing is enabled
+	print  []byte // checksum of the first bytes, see WithFingerprintMoves
+	id     fileID
+	hasID  bool   // false where the platform doesn't expose device and inode
+	target string // where a symlink points to, when not following them
+}
+
+// fileID identifies a file by its device and inode numbers.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func unwrapFileInfo(fi os.FileInfo) os.FileInfo {
+	if f, ok := fi.(*fileInfo); ok {
+		return f.FileInfo
+	}
+	return fi
+}
+
+func hashOf(fi os.FileInfo) []byte {
+	if f, ok := fi.(*fileInfo); ok {
+		return f.hash
+	}
+	return nil
+}
+
+func targetOf(fi os.FileInfo) string {
+	if f, ok := fi.(*fileInfo); ok {
+		return f.target
+	}
+	return ""
+}
+
+// sameFile reports whether fi1 and fi2 describe the same file. On unix the
+// device and inode numbers captured while listing are compared. Elsewhere,
+// or for infos without them (e.g. from an fs.FS), it asks os.SameFile and
+// falls back to a matching size, ModTime and base name, so a Rename can't
+// be detected there, only a Move keeping its name.
+func sameFile(fi1, fi2 os.FileInfo) bool {
+	if fi1 == nil || fi2 == nil {
+		return false
+	}
+	f1, ok1 := fi1.(*fileInfo)
+	f2, ok2 := fi2.(*fileInfo)
+	if ok1 && ok2 && f1.hasID && f2.hasID {
+		return f1.id == f2.id
+	}
+	if os.SameFile(unwrapFileInfo(fi1), unwrapFileInfo(fi2)) {
+		return true
+	}
+	return fi1.Size() == fi2.Size() && fi1.ModTime().Equal(fi2.ModTime()) && fi1.Name() == fi2.Name()
+}
+
+// sameContent reports whether fi1 and fi2 have the same size and
+// fingerprint, see WithFingerprintMoves.
+func sameContent(fi1, fi2 os.FileInfo) bool {
+	f1, ok1 := fi1.(*fileInfo)
+	f2, ok2 := fi2.(*fileInfo)
+	if !ok1 || !ok2 || f1.print == nil || f2.print == nil {
+		return false
+	}
+	return f1.Size() == f2.Size() && bytes.Equal(f1.print, f2.print)
+}
+
+// ownerChanged reports whether the owner or group differs, false where
+// either side doesn't expose them.
+func ownerChanged(fi1, fi2 os.FileInfo) bool {
+	uid1, gid1, ok1 := ownerOf(fi1)
+	uid2, gid2, ok2 := ownerOf(fi2)
+	return ok1 && ok2 && (uid1 != uid2 || gid1 != gid2)
+}
+
+// isModified compares checksums when both sides have one, ModTime + Size otherwise.
+func isModified(latest, curr os.FileInfo, ignoreModTime bool) bool {
+	if targetOf(latest) != targetOf(curr) {
+		return true // re-pointed, whether or not the link itself changed
+	}
+	latestHash, currHash := hashOf(latest), hashOf(curr)
+	if latestHash != nil && currHash != nil {
+		return !bytes.Equal(latestHash, currHash)
+	}
+	if ignoreModTime {
+		return latest.Size() != curr.Size()
+	}
+	return !latest.ModTime().Equal(curr.ModTime()) || latest.Size() != curr.Size()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fileSystem is what the watcher lists names through.
+type fileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	// ReadDirChunks calls fn with the entries of the directory name, up to
+	// n at a time where supported. The errors of fn are returned as is.
+	ReadDirChunks(name string, n int, fn func([]fs.DirEntry) error) error
+	Open(name string) (fs.File, error)
+	Glob(pattern string) ([]string, error)
+	Readlink(name string) (string, error)
+}
+
+// osFS is the default fileSystem, backed by the os package.
+type osFS struct{}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// ReadDirChunks doesn't hold a huge directory in memory at once, unlike
+// os.ReadDir the entries aren't sorted.
+func (osFS) ReadDirChunks(name string, n int, fn func([]fs.DirEntry) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		entries, err := f.ReadDir(n)
+		if len(entries) > 0 {
+			if err := fn(entries); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (osFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+// ioFS adapts an fs.FS, names are slash-separated and unrooted as fs.FS requires.
+type ioFS struct {
+	fsys fs.FS
+}
+
+func (f ioFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(f.fsys, name)
+}
+
+// Lstat is Stat, fs.FS has no notion of symlinks.
+func (f ioFS) Lstat(name string) (fs.FileInfo, error) {
+	return fs.Stat(f.fsys, name)
+}
+
+// ReadDirChunks reads the directory whole, through fs.ReadDirFS if the
+// fs.FS implements it.
+func (f ioFS) ReadDirChunks(name string, _ int, fn func([]fs.DirEntry) error) error {
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return err
+	}
+	return fn(entries)
+}
+
+func (f ioFS) Open(name string) (fs.File, error) {
+	return f.fsys.Open(name)
+}
+
+func (f ioFS) Glob(pattern string) ([]string, error) {
+	return fs.Glob(f.fsys, pattern)
+}
+
+// Readlink is unsupported, fs.FS has no notion of symlinks.
+func (f ioFS) Readlink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
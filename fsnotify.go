@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// FsnotifyOp mirrors fsnotify.Op.
+type FsnotifyOp uint32
+
+const (
+	FsnotifyCreate FsnotifyOp = 1 << iota
+	FsnotifyWrite
+	FsnotifyRemove
+	FsnotifyRename
+	FsnotifyChmod
+)
+
+func (op FsnotifyOp) String() string {
+	var buffer bytes.Buffer
+	if op&FsnotifyCreate == FsnotifyCreate {
+		buffer.WriteString("|CREATE")
+	}
+	if op&FsnotifyWrite == FsnotifyWrite {
+		buffer.WriteString("|WRITE")
+	}
+	if op&FsnotifyRemove == FsnotifyRemove {
+		buffer.WriteString("|REMOVE")
+	}
+	if op&FsnotifyRename == FsnotifyRename {
+		buffer.WriteString("|RENAME")
+	}
+	if op&FsnotifyChmod == FsnotifyChmod {
+		buffer.WriteString("|CHMOD")
+	}
+	if buffer.Len() == 0 {
+		return ""
+	}
+	return buffer.String()[1:]
+}
+
+// FsnotifyEvent mirrors fsnotify.Event.
+type FsnotifyEvent struct {
+	Name string
+	Op   FsnotifyOp
+}
+
+func (e FsnotifyEvent) Has(op FsnotifyOp) bool {
+	return e.Op&op != 0
+}
+
+// FsnotifyAdapter eases migrating from fsnotify.Watcher, it has the same
+// Add, Remove, Close, Events and Errors, backed by a polling Watcher.
+//
+// Semantics differ as changes are only seen when polling: they are reported
+// up to an interval late, several writes between polls make one Write, and
+// files created and removed between polls aren't reported at all. A Rename
+// is reported for the old name followed by a Create for the new one, like
+// fsnotify does, but only when the move is recognized, otherwise it's a
+// Remove and a Create. Modify, Truncate and Append map to Write, Chown to
+// Chmod.
+type FsnotifyAdapter struct {
+	Events chan FsnotifyEvent
+	Errors chan error
+
+	w    *Watcher
+	done chan struct{} // closed by Close
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// NewFsnotifyAdapter starts a Watcher polling every interval with opts.
+func NewFsnotifyAdapter(interval time.Duration, opts ...Option) (*FsnotifyAdapter, error) {
+	a := &FsnotifyAdapter{
+		Events: make(chan FsnotifyEvent),
+		Errors: make(chan error),
+		w:      NewWatcher(opts...),
+		done:   make(chan struct{}),
+	}
+	if err := a.w.Start(interval); err != nil {
+		return nil, err
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.forward()
+	}()
+	return a, nil
+}
+
+func (a *FsnotifyAdapter) Add(name string) error {
+	return a.w.Add(name)
+}
+
+func (a *FsnotifyAdapter) Remove(name string) error {
+	return a.w.Remove(name)
+}
+
+// Close stops the watcher and closes Events and Errors.
+func (a *FsnotifyAdapter) Close() error {
+	a.once.Do(func() {
+		close(a.done)
+		a.w.Close()
+		a.wg.Wait()
+		close(a.Events)
+		close(a.Errors)
+	})
+	return nil
+}
+
+// forward translates what the watcher reports until it's closed.
+func (a *FsnotifyAdapter) forward() {
+	events, errs := a.w.Events, a.w.Errors
+	for events != nil || errs != nil {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			for _, fe := range fsnotifyEvents(ev) {
+				select {
+				case a.Events <- fe:
+				case <-a.done:
+					return
+				}
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case a.Errors <- err:
+			case <-a.done:
+				return
+			}
+		}
+	}
+}
+
+// fsnotifyEvents maps ev to the events fsnotify would send for it.
+func fsnotifyEvents(ev Event) []FsnotifyEvent {
+	var events []FsnotifyEvent
+	if ev.Op&(Rename|Move) != 0 {
+		return []FsnotifyEvent{
+			{Name: ev.Path, Op: FsnotifyRename},
+			{Name: ev.NewPath, Op: FsnotifyCreate},
+		}
+	}
+	if ev.Op&Remove != 0 {
+		events = append(events, FsnotifyEvent{Name: ev.Path, Op: FsnotifyRemove})
+	}
+	var op FsnotifyOp
+	if ev.Op&Create != 0 {
+		op |= FsnotifyCreate
+	}
+	if ev.Op&(Modify|Truncate|Append) != 0 {
+		op |= FsnotifyWrite
+	}
+	if ev.Op&(Chmod|Chown) != 0 {
+		op |= FsnotifyChmod
+	}
+	if op != 0 {
+		events = append(events, FsnotifyEvent{Name: ev.Path, Op: op})
+	}
+	return events
+}
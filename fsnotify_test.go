@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFsnotifyAdapter(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	a, err := NewFsnotifyAdapter(10 * time.Millisecond)
+	require.NoError(t, err)
+	defer a.Close()
+
+	err = a.Add(dir)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	for {
+		select {
+		case ev := <-a.Events:
+			if ev.Name != filePath {
+				continue // the directory itself
+			}
+			require.True(t, ev.Has(FsnotifyCreate))
+			require.Equal(t, "CREATE", ev.Op.String())
+			return
+		case err := <-a.Errors:
+			t.Fatal(err)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the event")
+		}
+	}
+}
+
+func TestFsnotifyEvents(t *testing.T) {
+	require.Equal(t, []FsnotifyEvent{{Name: "a", Op: FsnotifyWrite | FsnotifyChmod}},
+		fsnotifyEvents(Event{Path: "a", Op: Append | Chmod}))
+	require.Equal(t, []FsnotifyEvent{{Name: "a", Op: FsnotifyRename}, {Name: "b", Op: FsnotifyCreate}},
+		fsnotifyEvents(Event{Path: "a", NewPath: "b", Op: Move}))
+	require.Equal(t, []FsnotifyEvent{{Name: "a", Op: FsnotifyRemove}, {Name: "a", Op: FsnotifyCreate}},
+		fsnotifyEvents(Event{Path: "a", Op: Remove | Create}))
+}
@@ -2,4 +2,12 @@ module github.com/elfiyang16/spooky-watcher
 
 go 1.19
 
-require go.uber.org/atomic v1.10.0
+require (
+	github.com/stretchr/testify v1.3.0
+	go.uber.org/atomic v1.10.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+)
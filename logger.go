@@ -0,0 +1,21 @@
+package main
+
+// Logger receives diagnostics that aren't reported on Errors, a
+// *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...any) {}
+
+// namedLogger prefixes lines with the watcher's name, see WithName.
+type namedLogger struct {
+	name string
+	l    Logger
+}
+
+func (l namedLogger) Printf(format string, v ...any) {
+	l.l.Printf("%s: "+format, append([]any{l.name}, v...)...)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Option func(*Watcher)
+
+// WithEventBuffer makes the Events channel buffered with capacity n, so up
+// to n events can be produced before polling blocks on the consumer.
+func WithEventBuffer(n int) Option {
+	return func(w *Watcher) {
+		w.eventBuffer = n
+	}
+}
+
+// WithErrorBuffer makes the Errors channel buffered with capacity n.
+func WithErrorBuffer(n int) Option {
+	return func(w *Watcher) {
+		w.errorBuffer = n
+	}
+}
+
+// WithMaxDepth bounds how deep a watched directory is listed, relative to
+// its root. Depth 0 (the default) lists only the root's immediate entries.
+func WithMaxDepth(n int) Option {
+	return func(w *Watcher) {
+		w.maxDepth = n
+	}
+}
+
+// WithContentHash makes Modify detection compare a SHA-256 checksum of
+// regular files no larger than maxHashSize instead of ModTime + Size.
+func WithContentHash() Option {
+	return func(w *Watcher) {
+		w.contentHash = true
+	}
+}
+
+// WithIgnoreModTime makes Modify detection compare only the Size, or the
+// checksum with WithContentHash, so touching a file isn't reported.
+func WithIgnoreModTime() Option {
+	return func(w *Watcher) {
+		w.ignoreModTime = true
+	}
+}
+
+// WithFingerprintMoves also pairs a removed and a created file as a Move
+// or Rename when they have the same size and their first 4 KiB have the
+// same checksum, so a copy followed by deleting the original is reported
+// as moved. Empty files aren't paired this way.
+func WithFingerprintMoves() Option {
+	return func(w *Watcher) {
+		w.fingerprints = true
+	}
+}
+
+// WithComparator makes fn decide how a file still present since the last
+// poll changed, returning the ops to report or 0 for none. It replaces the
+// Modify, Truncate, Append, Chmod and Chown detection, and options tuning
+// it such as WithIgnoreModTime.
+func WithComparator(fn func(old, curr os.FileInfo) Op) Option {
+	return func(w *Watcher) {
+		w.comparator = fn
+	}
+}
+
+// WithInitialScan makes the first poll emit a Create event for every file
+// already known to the watcher.
+func WithInitialScan() Option {
+	return func(w *Watcher) {
+		w.initialScan = true
+	}
+}
+
+// WithDebounce coalesces repeated events with Modify for the same path,
+// the event is emitted once the path has been quiet for d.
+func WithDebounce(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.debounce = d
+	}
+}
+
+// WithPollJitter randomizes each poll interval by up to ±frac of it, so
+// watchers started together don't poll together. frac is capped to [0, 0.9].
+func WithPollJitter(frac float64) Option {
+	return func(w *Watcher) {
+		w.jitter = math.Max(0, math.Min(frac, 0.9))
+	}
+}
+
+// WithErrorBackoff doubles the poll interval after each poll that had
+// errors, up to max, until a poll succeeds again.
+func WithErrorBackoff(max time.Duration) Option {
+	return func(w *Watcher) {
+		w.errorBackoff = max
+	}
+}
+
+// WithAggregateWindow emits at most one event per path every d, with the
+// ops detected meanwhile OR'ed together, e.g. Create|Modify. Unlike
+// WithDebounce, further changes don't delay it.
+func WithAggregateWindow(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.aggregate = d
+	}
+}
+
+// WithStableModTime holds the Modify, Truncate or Append events of a file
+// until it's left unchanged for n polls, so a file still being written is
+// reported once the writes are over.
+func WithStableModTime(n int) Option {
+	return func(w *Watcher) {
+		w.stablePolls = n
+	}
+}
+
+// WithCoalesceShortLived holds Create events for d, a path removed again
+// meanwhile is reported with neither event.
+func WithCoalesceShortLived(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.coalesce = d
+	}
+}
+
+// WithIgnoreHidden skips entries whose name starts with a dot, hidden
+// directories aren't descended into. Watched names themselves are kept.
+func WithIgnoreHidden() Option {
+	return func(w *Watcher) {
+		w.ignoreHidden = true
+	}
+}
+
+// WithMissingRetries keeps a watched name that no longer exists until it
+// has been missing for n consecutive polls, rather than dropping it on the
+// first one. This tolerates a file being replaced atomically.
+func WithMissingRetries(n int) Option {
+	return func(w *Watcher) {
+		w.missingRetries = n
+	}
+}
+
+// WithDrainOnClose makes Close run one last poll so changes made just
+// before it aren't lost. Events from that poll are sent on Events as long as
+// it doesn't block, the remainder is kept in order and returned by Pending,
+// along with those of a poll that was blocked sending when Close was called.
+func WithDrainOnClose() Option {
+	return func(w *Watcher) {
+		w.drainOnClose = true
+	}
+}
+
+// WithNonBlocking drops events the consumer isn't ready for instead of
+// blocking the poll loop. Dropped events are counted by Dropped, and a poll
+// that dropped any reports a single OverflowError on Errors. Errors are
+// dropped as well when nobody is ready for them.
+func WithNonBlocking() Option {
+	return func(w *Watcher) {
+		w.nonBlocking = true
+	}
+}
+
+// WithFS makes the watcher list names in fsys instead of the OS filesystem.
+func WithFS(fsys fs.FS) Option {
+	return func(w *Watcher) {
+		w.fs = ioFS{fsys: fsys}
+	}
+}
+
+// WithClock replaces the real clock, letting tests drive polls manually.
+func WithClock(c Clock) Option {
+	return func(w *Watcher) {
+		w.clock = c
+	}
+}
+
+// WithAutoReAdd keeps watching names that no longer exist, so they are
+// reported as created again once they come back. Only the first poll that
+// finds a name missing reports an error for it.
+func WithAutoReAdd() Option {
+	return func(w *Watcher) {
+		w.autoReAdd = true
+	}
+}
+
+// WithErrorDedup reports the same error for the same watched name at most
+// once per window d.
+func WithErrorDedup(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.errorDedup = d
+	}
+}
+
+// WithConcurrency caps how many watched names are listed at the same time
+// on each poll, it defaults to the number of CPUs.
+func WithConcurrency(n int) Option {
+	return func(w *Watcher) {
+		w.concurrency = n
+	}
+}
+
+// WithFollowSymlinks decides how the symlinks found under watched names are
+// watched. When follow is true a link is resolved and its target watched,
+// directories reached twice aren't listed again so link loops terminate.
+// Otherwise, the default, the link itself is watched. Watched names are
+// always resolved, so adding a link to a directory lists the directory.
+func WithFollowSymlinks(follow bool) Option {
+	return func(w *Watcher) {
+		w.followSymlinks = follow
+	}
+}
+
+// WithLogger sets where diagnostics go, they are discarded by default.
+func WithLogger(l Logger) Option {
+	return func(w *Watcher) {
+		w.logger = l
+	}
+}
+
+// WithName names the watcher in its WatchErrors and the lines it logs, to
+// tell several watchers apart.
+func WithName(name string) Option {
+	return func(w *Watcher) {
+		w.name = name
+	}
+}
+
+// WithRequireWatches makes Start return ErrNoWatches when nothing was added.
+func WithRequireWatches() Option {
+	return func(w *Watcher) {
+		w.requireWatches = true
+	}
+}
+
+// WithFilter delivers only the events fn returns true for, it can be
+// replaced later with SetFilter.
+func WithFilter(fn func(Event) bool) Option {
+	return func(w *Watcher) {
+		w.SetFilter(fn)
+	}
+}
+
+// FilesOnly leaves out events about directories.
+func FilesOnly() Option {
+	return WithFilter(func(ev Event) bool {
+		return !ev.IsDirEvent()
+	})
+}
+
+// DirsOnly leaves out events about anything but directories.
+func DirsOnly() Option {
+	return WithFilter(func(ev Event) bool {
+		return ev.IsDirEvent()
+	})
+}
+
+// WatchExtensions leaves out events about files whose extension isn't one
+// of exts, e.g. ".go", compared ignoring case and the leading dot. Events
+// about directories are kept. It applies on top of a filter set before it.
+func WatchExtensions(exts ...string) Option {
+	set := make(map[string]struct{}, len(exts))
+	for _, ext := range exts {
+		set["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = struct{}{}
+	}
+	matches := func(path string) bool {
+		_, ok := set[strings.ToLower(filepath.Ext(path))]
+		return ok
+	}
+	return func(w *Watcher) {
+		prev := w.filter.Load()
+		w.SetFilter(func(ev Event) bool {
+			if prev != nil && !(*prev)(ev) {
+				return false
+			}
+			return ev.IsDirEvent() || matches(ev.Path) || ev.NewPath != "" && matches(ev.NewPath)
+		})
+	}
+}
+
+// WithAppendDetection reports files that only grew with Append rather than
+// Modify. With WithContentHash the previous content must be left unchanged
+// for it to count, otherwise growing is enough.
+func WithAppendDetection() Option {
+	return func(w *Watcher) {
+		w.appendDetection = true
+	}
+}
+
+// WithOwnershipTracking reports owner or group changes with Chown, where
+// the platform exposes them.
+func WithOwnershipTracking() Option {
+	return func(w *Watcher) {
+		w.ownership = true
+	}
+}
+
+// WithCaseInsensitive treats paths differing only by case as the same file,
+// as on macOS and Windows, so changing the case of a name is a Rename.
+func WithCaseInsensitive() Option {
+	return func(w *Watcher) {
+		w.caseInsensitive = true
+	}
+}
+
+// WithBatchEvents delivers the events of each poll together as one slice on
+// Batches instead of one by one on Events, polls without any send nothing.
+func WithBatchEvents() Option {
+	return func(w *Watcher) {
+		w.batchEvents = true
+	}
+}
+
+// WithWatchParentForFiles handles editors saving a watched file by moving
+// it away and writing a new one. A file added by name that is missing for
+// a single poll while its directory exists is assumed to be being replaced,
+// so it's reported with Modify once back rather than Remove and Create.
+func WithWatchParentForFiles() Option {
+	return func(w *Watcher) {
+		w.watchParent = true
+	}
+}
+
+// WithMaxFiles caps how many files are watched to n. Polls finding more
+// watch the first n by path and report ErrTooManyFiles.
+func WithMaxFiles(n int) Option {
+	return func(w *Watcher) {
+		w.maxFiles = n
+	}
+}
+
+// WithHistory keeps the latest n events emitted for History, whether or
+// not they are read from Events.
+func WithHistory(n int) Option {
+	return func(w *Watcher) {
+		w.historySize = n
+	}
+}
+
+// WithSortedEvents emits the events detected by each poll ordered by Path,
+// then Op, rather than in no particular order.
+func WithSortedEvents() Option {
+	return func(w *Watcher) {
+		w.sortedEvents = true
+	}
+}
+
+// WithSuppressDirModify leaves Modify out of events about directories, most
+// filesystems update their ModTime as entries come and go, which the events
+// of the entries already tell. Chmod and other ops are still reported.
+func WithSuppressDirModify() Option {
+	return func(w *Watcher) {
+		w.suppressDirModify = true
+	}
+}
+
+// AddOption configures how a single name is watched, see AddWith.
+type AddOption func(*nameOptions)
+
+type nameOptions struct {
+	maxDepth int
+	ignores  []string
+	filter   func(Event) bool
+}
+
+// AddRecursive is WithMaxDepth for the name only.
+func AddRecursive(depth int) AddOption {
+	return func(o *nameOptions) {
+		o.maxDepth = depth
+	}
+}
+
+// AddIgnore is Ignore for the entries of the name only.
+func AddIgnore(patterns ...string) AddOption {
+	return func(o *nameOptions) {
+		o.ignores = append(o.ignores, patterns...)
+	}
+}
+
+// AddFilter is WithFilter for the events under the name only.
+func AddFilter(fn func(Event) bool) AddOption {
+	return func(o *nameOptions) {
+		o.filter = fn
+	}
+}
+
+// WithReadRetries retries reading a directory or a file's info up to n times
+// when it fails, e.g. on network filesystems, waiting base and then twice as
+// long each time. Missing files aren't retried.
+func WithReadRetries(n int, base time.Duration) Option {
+	return func(w *Watcher) {
+		w.readRetries = n
+		w.readBackoff = base
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// snapshotVersion is bumped whenever the snapshot format changes.
+const snapshotVersion = 2
+
+type snapshot struct {
+	Version int                     `json:"version"`
+	Names   []snapshotName          `json:"names"`
+	Aliases map[string]string       `json:"aliases,omitempty"`
+	Files   map[string]snapshotFile `json:"files"`
+}
+
+// snapshotName is a watched name with its AddWith options, but for the
+// filter which can't be encoded.
+type snapshotName struct {
+	Name     string   `json:"name"`
+	MaxDepth int      `json:"maxDepth"`
+	Ignores  []string `json:"ignores,omitempty"`
+}
+
+type snapshotFile struct {
+	*FileSummary
+	Hash  []byte `json:"hash,omitempty"`
+	Print []byte `json:"print,omitempty"`
+	Dev   uint64 `json:"dev,omitempty"`
+	Ino   uint64 `json:"ino,omitempty"`
+	HasID bool   `json:"hasID,omitempty"`
+
+	Target string `json:"target,omitempty"`
+}
+
+// Snapshot encodes the watched names and what is known of their files, so a
+// new watcher seeded with RestoreSnapshot only reports what changed since.
+// The options of AddWith are kept, except for AddFilter.
+func (w *Watcher) Snapshot() ([]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := snapshot{
+		Version: snapshotVersion,
+		Names:   make([]snapshotName, 0, len(w.names)),
+		Aliases: make(map[string]string, len(w.aliases)),
+		Files:   make(map[string]snapshotFile, len(w.files)),
+	}
+	for name, o := range w.names {
+		s.Names = append(s.Names, snapshotName{Name: name, MaxDepth: o.maxDepth, Ignores: o.ignores})
+	}
+	for alias, name := range w.aliases {
+		s.Aliases[alias] = name
+	}
+	for fp, fi := range w.files {
+		sf := snapshotFile{FileSummary: summarize(fi)}
+		if f, ok := fi.(*fileInfo); ok {
+			sf.Hash, sf.Print = f.hash, f.print
+			sf.Dev, sf.Ino, sf.HasID = f.id.dev, f.id.ino, f.hasID
+			sf.Target = f.target
+		}
+		s.Files[fp] = sf
+	}
+	return json.Marshal(s)
+}
+
+// RestoreSnapshot replaces the watched names and their files with the ones
+// of a Snapshot, it must be called before Start. A snapshot of another
+// version is rejected with ErrSnapshotVersion, leaving the watcher as is.
+func (w *Watcher) RestoreSnapshot(data []byte) error {
+	if w.IsClosed() {
+		return ErrWatcherClosed
+	}
+	if w.running.Load() != stateIdle {
+		return ErrWatcherStarted
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("snapshot with error %w", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("%w %d", ErrSnapshotVersion, s.Version)
+	}
+
+	names := make(map[string]*nameOptions, len(s.Names))
+	for _, sn := range s.Names {
+		names[sn.Name] = &nameOptions{maxDepth: sn.MaxDepth, ignores: sn.Ignores}
+	}
+	aliases := make(map[string]string, len(s.Aliases))
+	for alias, name := range s.Aliases {
+		if _, ok := names[name]; ok {
+			aliases[alias] = name
+		}
+	}
+	files := make(map[string]os.FileInfo, len(s.Files))
+	for fp, sf := range s.Files {
+		if sf.FileSummary == nil {
+			return fmt.Errorf("snapshot with error no info for %s", fp)
+		}
+		files[fp] = &fileInfo{
+			FileInfo: sf.FileSummary,
+			hash:     sf.Hash,
+			print:    sf.Print,
+			id:       fileID{dev: sf.Dev, ino: sf.Ino},
+			hasID:    sf.HasID,
+			target:   sf.Target,
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.names = names
+	w.aliases = aliases
+	w.files = files
+	return nil
+}
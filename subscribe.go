@@ -0,0 +1,76 @@
+package main
+
+import "sync"
+
+// subscriber receives the events under prefix, see Subscribe.
+type subscriber struct {
+	prefix string
+	ch     chan Event
+	done   chan struct{} // closed on unsubscribe
+	once   sync.Once
+}
+
+// Subscribe returns a channel receiving the events whose Path is prefix or
+// under it, alongside the ones delivered as usual. A relative prefix is
+// resolved like the names passed to Add. It's buffered like Events and
+// blocks polling the same way. The returned func unsubscribes and closes
+// the channel, which is also closed by Close.
+func (w *Watcher) Subscribe(prefix string) (<-chan Event, func()) {
+	sub := &subscriber{
+		prefix: w.normalize(prefix),
+		ch:     make(chan Event, w.eventBuffer),
+		done:   make(chan struct{}),
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.IsClosed() {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	w.subs[sub] = struct{}{}
+
+	return sub.ch, func() {
+		sub.once.Do(func() {
+			// unblocks a send in progress, which holds the lock
+			close(sub.done)
+
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if _, ok := w.subs[sub]; ok {
+				delete(w.subs, sub)
+				close(sub.ch)
+			}
+		})
+	}
+}
+
+// publish sends ev to the subscribers it's under.
+func (w *Watcher) publish(ev Event) {
+	for sub := range w.subs {
+		if !isUnder(ev.Path, sub.prefix) {
+			continue
+		}
+		if w.draining || w.nonBlocking {
+			select {
+			case sub.ch <- ev:
+			default:
+			}
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		case <-sub.done:
+		case <-w.closed:
+		}
+	}
+}
+
+// closeSubs closes the channels of all subscribers, w.mu must be held.
+func (w *Watcher) closeSubs() {
+	for sub := range w.subs {
+		delete(w.subs, sub)
+		close(sub.ch)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// WaitFor reads w.Events until an event for path with op arrives, other
+// events are discarded. It fails with the first error read from w.Errors,
+// with ErrWatcherClosed once the watcher is closed, or with an error
+// wrapping os.ErrDeadlineExceeded after timeout.
+func WaitFor(w *Watcher, path string, op Op, timeout time.Duration) error {
+	path = w.normalize(path) // like event paths
+	_, err := waitFor(w, timeout, func(ev Event) bool {
+		return ev.Path == path && ev.HasOps(op)
+	}, fmt.Sprintf("%s %s", op, path))
+	return err
+}
+
+// Range calls fn with each event read from w.Events until ctx is done,
+// which returns ctx.Err(), or the watcher is closed, which returns nil. It
+// fails with the first error fn returns or read from w.Errors.
+func (w *Watcher) Range(ctx context.Context, fn func(Event) error) error {
+	for {
+		// checked first, so no event is handled once ctx is done
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if err := fn(ev); err != nil {
+				return err
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WatchOnce watches name polling every interval until an event with op
+// arrives for it or anything under it, and returns that event. The watcher
+// is closed before returning, it fails like WaitFor otherwise.
+func WatchOnce(name string, op Op, interval, timeout time.Duration, opts ...Option) (Event, error) {
+	return watchOnce(NewWatcher(opts...), name, op, interval, timeout)
+}
+
+func watchOnce(w *Watcher, name string, op Op, interval, timeout time.Duration) (Event, error) {
+	defer w.Close()
+
+	if err := w.Add(name); err != nil {
+		return Event{}, err
+	}
+	if err := w.Start(interval); err != nil {
+		return Event{}, err
+	}
+	return waitFor(w, timeout, func(ev Event) bool {
+		return ev.HasOps(op)
+	}, fmt.Sprintf("%s under %s", op, name))
+}
+
+// waitFor returns the first event of w matching, what describes it for the
+// timeout error.
+func waitFor(w *Watcher, timeout time.Duration, match func(Event) bool, what string) (Event, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return Event{}, ErrWatcherClosed
+			}
+			if match(ev) {
+				return ev, nil
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return Event{}, ErrWatcherClosed
+			}
+			return Event{}, err
+		case <-timer.C:
+			return Event{}, fmt.Errorf("wait for %s: %w", what, os.ErrDeadlineExceeded)
+		}
+	}
+}
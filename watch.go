@@ -1,79 +1,539 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"go.uber.org/atomic"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 var (
-	ErrWatcherStarted = errors.New("watcher already started")
-	ErrWatcherClosed  = errors.New("watcher already closed")
+	ErrWatcherStarted  = errors.New("watcher already started")
+	ErrWatcherClosed   = errors.New("watcher already closed")
+	ErrInvalidInterval = errors.New("poll interval must be positive")
+	ErrNoWatches       = errors.New("no names to watch")
+	ErrTooManyFiles    = errors.New("too many files to watch")
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+	ErrAlreadyWatching = errors.New("name already watched")
 )
 
+// WatchError is reported on Errors when a watched name can't be listed.
+type WatchError struct {
+	Watcher string // see WithName
+	Name    string
+	Err     error
+}
+
+func (e *WatchError) Error() string {
+	if e.Watcher != "" {
+		return fmt.Sprintf("%s: watch %s: %v", e.Watcher, e.Name, e.Err)
+	}
+	return fmt.Sprintf("watch %s: %v", e.Name, e.Err)
+}
+
+func (e *WatchError) Unwrap() error {
+	return e.Err
+}
+
+// OverflowError is reported on Errors when a poll dropped events, see WithNonBlocking.
+type OverflowError struct {
+	Dropped uint64
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("dropped %d events", e.Dropped)
+}
+
+// Stats is a snapshot of what a watcher has done so far.
+type Stats struct {
+	Polls            uint64
+	Events           map[Op]uint64 // emitted events by op, dropped ones included
+	Errors           uint64
+	LastPollDuration time.Duration
+	Files            int // files currently tracked
+}
+
+// fingerprintSize is how much of a file is checksummed by
+// WithFingerprintMoves.
+const fingerprintSize = 4 << 10
+
+// readDirChunk is how many entries of an OS directory are read at once.
+const readDirChunk = 1024
+
+// maxHashSize is the largest file that is checksummed by WithContentHash.
+const maxHashSize = 1 << 20
+
+const (
+	stateIdle int32 = iota
+	stateRunning
+	stateClosed
+)
+
+// Watcher polls the names it watches for changes. Events and Errors are
+// unbuffered unless WithEventBuffer and WithErrorBuffer say otherwise, once
+// a buffer is full the poll loop blocks until the consumer catches up, so
+// nothing is lost but detection is delayed. WithNonBlocking drops instead.
 type Watcher struct {
 	Events  chan Event
+	Batches chan []Event // only used with WithBatchEvents
 	Errors  chan error
 	closed  chan struct{}
-	names   map[string]struct{}    // list of names to watch
-	files   map[string]os.FileInfo // all files to watch up to date
+	done    chan struct{}            // closed once Close has finished
+	started chan struct{}            // closed once doWatch is polling
+	names   map[string]*nameOptions  // names to watch, see AddWith
+	aliases map[string]string        // names as passed to Add, when normalized
+	files   map[string]os.FileInfo   // all files to watch up to date
+	ops     Op                       // ops to deliver, 0 for all
+	ignores atomic.Pointer[[]string] // patterns of entries to leave out
+	filter  atomic.Pointer[func(Event) bool]
 	wg      sync.WaitGroup
-	running atomic.Int32 // default to 0
+	running atomic.Int32 // default to stateIdle
+	paused  atomic.Bool
+	dropped atomic.Uint64
+	seq     atomic.Uint64
 	mu      sync.Mutex
+	pollMu  sync.Mutex // serializes poll cycles
+	stateMu sync.Mutex // serializes Start and Close, see StartContext
+
+	historyMu   sync.Mutex // not mu, so History works while a send blocks
+	history     []Event    // ring of the latest events, see WithHistory
+	historyNext int
+	historySize int
+
+	polls        atomic.Uint64
+	errCount     atomic.Uint64
+	lastPollTook atomic.Duration
+	failures     atomic.Int32  // consecutive polls that had errors
+	lastPoll     atomic.Time   // when doWatch last polled
+	opCounts     map[Op]uint64 // guarded by mu
+
+	interval      atomic.Duration
+	resetInterval chan struct{}
+
+	debounced map[string]debouncedEvent // pending events with Modify by path
+	misses    map[string]int            // consecutive polls a name was missing
+	replaced  map[string]struct{}       // files watched through their parent, see WithWatchParentForFiles
+	draining  bool                      // set by doWatch for the poll run on Close
+	pending   []Event                   // events of that poll that couldn't be sent
+	called    []Event                   // events for OnEvent, called once mu is released
+	batch     []Event                   // events of this poll, see WithBatchEvents
+	errSent   map[string]time.Time      // last time an error was reported, see WithErrorDedup
+	subs      map[*subscriber]struct{}  // see Subscribe
+	muted     map[string]struct{}       // see Mute
+	held      map[string]debouncedEvent // Create events by path, see WithCoalesceShortLived
+	windows   map[string]debouncedEvent // events by path, see WithAggregateWindow
+	unstable  map[string]stableEvent    // Modify events by path, see WithStableModTime
+
+	fs           fileSystem
+	clock        Clock
+	logger       Logger
+	name         string
+	eventBuffer  int
+	errorBuffer  int
+	maxDepth     int
+	contentHash  bool
+	initialScan  bool
+	debounce     time.Duration
+	coalesce     time.Duration
+	aggregate    time.Duration
+	stablePolls  int
+	jitter       float64
+	errorBackoff time.Duration
+
+	ignoreHidden    bool
+	missingRetries  int
+	drainOnClose    bool
+	nonBlocking     bool
+	autoReAdd       bool
+	errorDedup      time.Duration
+	concurrency     int
+	followSymlinks  bool
+	requireWatches  bool
+	appendDetection bool
+	ignoreModTime   bool
+	fingerprints    bool
+	comparator      func(old, curr os.FileInfo) Op
+	ownership       bool
+	caseInsensitive bool
+	batchEvents     bool
+	watchParent     bool
+	maxFiles        int
+	sortedEvents    bool
+	readRetries     int
+	readBackoff     time.Duration
+
+	suppressDirModify bool
+
+	onEvent func(Event)
+	onError func(error)
+}
+
+type debouncedEvent struct {
+	ev       Event
+	lastSeen time.Time
 }
 
-func NewWatcher() *Watcher {
-	return &Watcher{
-		Events: make(chan Event),
-		Errors: make(chan error),
-		closed: make(chan struct{}),
-		names:  make(map[string]struct{}),
-		files:  make(map[string]os.FileInfo),
+type stableEvent struct {
+	ev    Event
+	polls int // since the file last changed
+}
+
+func NewWatcher(opts ...Option) *Watcher {
+	w := &Watcher{
+		closed:  make(chan struct{}),
+		done:    make(chan struct{}),
+		started: make(chan struct{}),
+
+		resetInterval: make(chan struct{}, 1),
+		names:         make(map[string]*nameOptions),
+		aliases:       make(map[string]string),
+		files:         make(map[string]os.FileInfo),
+
+		debounced: make(map[string]debouncedEvent),
+		misses:    make(map[string]int),
+		replaced:  make(map[string]struct{}),
+		errSent:   make(map[string]time.Time),
+		opCounts:  make(map[Op]uint64),
+		subs:      make(map[*subscriber]struct{}),
+		held:      make(map[string]debouncedEvent),
+		windows:   make(map[string]debouncedEvent),
+		muted:     make(map[string]struct{}),
+		unstable:  make(map[string]stableEvent),
+
+		fs:             osFS{},
+		clock:          realClock{},
+		logger:         nopLogger{},
+		missingRetries: 1,
+		concurrency:    runtime.NumCPU(),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.name != "" {
+		w.logger = namedLogger{name: w.name, l: w.logger}
+	}
+	w.Events = make(chan Event, w.eventBuffer)
+	w.Errors = make(chan error, w.errorBuffer)
+	if w.batchEvents {
+		w.Batches = make(chan []Event, w.eventBuffer)
 	}
+	return w
 }
 
 func (w *Watcher) Start(d time.Duration) error {
-	if !w.running.CompareAndSwap(0, 1) {
-		return ErrWatcherStarted
-	}
+	return w.StartContext(context.Background(), d)
+}
 
-	select {
-	case <-w.closed:
+// StartContext is like Start, but the watcher is closed as if Close() were
+// called once ctx is done.
+func (w *Watcher) StartContext(ctx context.Context, d time.Duration) error {
+	if w.IsClosed() {
 		return ErrWatcherClosed
-	default:
 	}
-
+	if d <= 0 {
+		return ErrInvalidInterval
+	}
+	if w.requireWatches {
+		w.mu.Lock()
+		n := len(w.names)
+		w.mu.Unlock()
+		if n == 0 {
+			return ErrNoWatches
+		}
+	}
+	// the poll goroutine is added to wg before Close can see it running
+	w.stateMu.Lock()
+	if !w.running.CompareAndSwap(stateIdle, stateRunning) {
+		w.stateMu.Unlock()
+		if w.running.Load() == stateClosed {
+			return ErrWatcherClosed // closed meanwhile
+		}
+		return ErrWatcherStarted
+	}
+	w.interval.Store(d)
 	w.wg.Add(1)
+	w.stateMu.Unlock()
+
 	go func() {
 		defer w.wg.Done()
-		w.doWatch(d)
+		w.doWatch()
 	}()
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.Close()
+			case <-w.closed:
+			}
+		}()
+	}
 	return nil
 }
 
 func (w *Watcher) Close() {
+	w.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but gives up waiting for the poll goroutine
+// once ctx is done, e.g. when stuck in an OnEvent callback, and returns
+// ctx.Err(). The goroutine is then leaked until it returns, the channels
+// are closed and Wait returns only after that.
+func (w *Watcher) CloseContext(ctx context.Context) error {
+	w.stateMu.Lock()
 	// already closed
-	if !w.running.CompareAndSwap(0, 1) {
-		return
+	if w.running.Swap(stateClosed) == stateClosed {
+		w.stateMu.Unlock()
+		return nil
 	}
-
 	close(w.closed)
-	w.wg.Wait()
+	w.stateMu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.wg.Wait()
+	}()
+
+	select {
+	case <-stopped:
+		w.finishClose()
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-stopped
+			w.finishClose()
+		}()
+		return ctx.Err()
+	}
+}
+
+// finishClose releases what the poll goroutine used once it has returned.
+func (w *Watcher) finishClose() {
+	// wait for a PollNow still sending
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
 
 	close(w.Events)
 	close(w.Errors)
+	if w.Batches != nil {
+		close(w.Batches)
+	}
 
 	w.mu.Lock()
-	w.names = make(map[string]struct{})
+	w.names = make(map[string]*nameOptions)
+	w.aliases = make(map[string]string)
 	w.files = make(map[string]os.FileInfo)
+	w.closeSubs()
 	w.mu.Unlock()
+
+	close(w.done)
+}
+
+// Reset returns a closed watcher to the state NewWatcher left it in, with
+// new channels and nothing watched, so it can be started again. Options,
+// callbacks and filters are kept. Reset is invalid while running, it
+// returns ErrWatcherStarted then.
+func (w *Watcher) Reset() error {
+	switch w.running.Load() {
+	case stateRunning:
+		return ErrWatcherStarted
+	case stateClosed:
+		<-w.done // let Close finish
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.Events = make(chan Event, w.eventBuffer)
+	w.Errors = make(chan error, w.errorBuffer)
+	if w.batchEvents {
+		w.Batches = make(chan []Event, w.eventBuffer)
+	}
+	w.closed = make(chan struct{})
+	w.done = make(chan struct{})
+	w.started = make(chan struct{})
+
+	w.names = make(map[string]*nameOptions)
+	w.aliases = make(map[string]string)
+	w.files = make(map[string]os.FileInfo)
+	w.debounced = make(map[string]debouncedEvent)
+	w.misses = make(map[string]int)
+	w.replaced = make(map[string]struct{})
+	w.errSent = make(map[string]time.Time)
+	w.opCounts = make(map[Op]uint64)
+	w.subs = make(map[*subscriber]struct{})
+	w.held = make(map[string]debouncedEvent)
+	w.windows = make(map[string]debouncedEvent)
+	w.muted = make(map[string]struct{})
+	w.unstable = make(map[string]stableEvent)
+	w.pending = nil
+	w.called = nil
+	w.draining = false
+
+	w.historyMu.Lock()
+	w.history, w.historyNext = nil, 0
+	w.historyMu.Unlock()
+
+	w.paused.Store(false)
+	w.dropped.Store(0)
+	w.seq.Store(0)
+	w.polls.Store(0)
+	w.errCount.Store(0)
+	w.lastPollTook.Store(0)
+	w.failures.Store(0)
+	w.lastPoll.Store(time.Time{})
+	w.running.Store(stateIdle)
+	return nil
+}
+
+// OnEvent makes the watcher call fn for each event instead of sending it
+// on Events. fn runs synchronously in the poll goroutine once the poll
+// detected all its events, in the order they were detected, so a slow fn
+// delays the next poll. fn may call the watcher's methods, except PollNow
+// and Close as the poll isn't over yet. It must be set before Start.
+func (w *Watcher) OnEvent(fn func(Event)) {
+	w.onEvent = fn
+}
+
+// OnError is like OnEvent for the errors otherwise sent on Errors.
+func (w *Watcher) OnError(fn func(error)) {
+	w.onError = fn
+}
+
+// Pause suppresses events until Resume is called. The watcher keeps
+// polling meanwhile, so changes made while paused are never reported.
+func (w *Watcher) Pause() {
+	w.paused.Store(true)
+}
+
+func (w *Watcher) Resume() {
+	w.paused.Store(false)
+}
+
+// LastPollTime returns when the running watcher last polled, zero before
+// its first poll.
+func (w *Watcher) LastPollTime() time.Time {
+	return w.lastPoll.Load()
+}
+
+// Healthy reports whether the watcher is running and polled within maxStale.
+func (w *Watcher) Healthy(maxStale time.Duration) bool {
+	last := w.LastPollTime()
+	return w.IsRunning() && !last.IsZero() && w.clock.Now().Sub(last) <= maxStale
+}
+
+// Dropped returns how many events were dropped, see WithNonBlocking.
+func (w *Watcher) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Pending returns the events of the poll run on Close that couldn't be sent
+// on Events, see WithDrainOnClose.
+func (w *Watcher) Pending() []Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pending := make([]Event, len(w.pending))
+	copy(pending, w.pending)
+	return pending
+}
+
+func (w *Watcher) IsRunning() bool {
+	return w.running.Load() == stateRunning
+}
+
+func (w *Watcher) IsClosed() bool {
+	select {
+	case <-w.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Started returns a channel closed once the watcher started by Start is
+// polling, so changes made from then on are reported.
+func (w *Watcher) Started() <-chan struct{} {
+	return w.started
+}
+
+// Wait blocks until the watcher is closed and its channels are closed,
+// it returns immediately if the watcher was never started.
+func (w *Watcher) Wait() {
+	if w.running.Load() == stateIdle {
+		return
+	}
+	<-w.done
 }
 
 func (w *Watcher) Add(name string) error {
+	return w.AddAll(name)
+}
+
+// AddWith is like Add, with options applying to name only.
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
+	o := w.defaultNameOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return w.addAll([]string{name}, o)
+}
+
+// AddAll adds all of names, or none of them if any fails to be listed or
+// is already watched, which fails with ErrAlreadyWatching.
+func (w *Watcher) AddAll(names ...string) error {
+	return w.addAll(names, w.defaultNameOptions())
+}
+
+// AddAsync is like Add, listing name in the background instead of blocking
+// for large trees. The returned channel receives the result, nil once name
+// is watched, then is closed. Nothing under name is reported meanwhile.
+func (w *Watcher) AddAsync(name string) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		errc <- w.Add(name)
+	}()
+	return errc
+}
+
+func (w *Watcher) defaultNameOptions() *nameOptions {
+	return &nameOptions{maxDepth: w.maxDepth}
+}
+
+func (w *Watcher) addAll(names []string, o *nameOptions) error {
+	if w.IsClosed() {
+		return ErrWatcherClosed
+	}
+
+	// list without holding the lock, so polls aren't blocked meanwhile
+	keys := make([]string, len(names))
+	listings := make([]*listing, 0, len(names))
+	for i, name := range names {
+		keys[i] = w.normalize(name)
+		l, err := w.listForName(keys[i], o)
+		if err != nil {
+			return err
+		}
+		for _, err := range l.errs {
+			w.logger.Printf("watch %s: %v", name, err)
+		}
+		listings = append(listings, l)
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -83,15 +543,28 @@ func (w *Watcher) Add(name string) error {
 	default:
 	}
 
-	fileList, err := listForName(name)
-	if err != nil {
-		return err
+	seen := make(map[string]struct{}, len(names))
+	for i, name := range names {
+		_, watched := w.names[keys[i]]
+		if _, ok := seen[keys[i]]; ok || watched {
+			return fmt.Errorf("%w: %s", ErrAlreadyWatching, name)
+		}
+		seen[keys[i]] = struct{}{}
 	}
 
-	w.names[name] = struct{}{}
-	for fp, fi := range fileList {
-		w.files[fp] = fi
+	for i, name := range names {
+		w.names[keys[i]] = o
+		if keys[i] != name {
+			w.aliases[name] = keys[i]
+		}
+		if fi, ok := listings[i].files[keys[i]]; ok && w.watchParent && fi.Mode().IsRegular() {
+			w.replaced[keys[i]] = struct{}{}
+		}
+		for fp, fi := range listings[i].files {
+			w.files[fp] = fi
+		}
 	}
+	w.capFiles(w.files) // reported by the next poll
 	return nil
 }
 
@@ -105,170 +578,1169 @@ func (w *Watcher) Remove(name string) error {
 	default:
 	}
 
-	w.doRemove(name)
+	key, ok := w.aliases[name]
+	if !ok {
+		key = w.normalize(name)
+	}
+	w.doRemove(key)
+	for alias, key := range w.aliases {
+		if _, ok := w.names[key]; !ok {
+			delete(w.aliases, alias)
+		}
+	}
 	return nil
 }
 
-func (w *Watcher) doWatch(d time.Duration) {
-	ticker := time.NewTicker(d)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-w.closed:
-			return
-		case <-ticker.C:
-			currFileList := w.listForAll()
-			w.pollEvents(currFileList)
-			w.mu.Lock()
-			w.files = currFileList
-			w.mu.Unlock()
-		}
+// normalize returns the key name is watched by, its absolute path for the
+// OS filesystem so event paths don't depend on the working directory.
+func (w *Watcher) normalize(name string) string {
+	if _, ok := w.fs.(osFS); !ok {
+		return name // relative to the fs.FS
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return filepath.Clean(name)
 	}
+	return abs
 }
 
-func (w *Watcher) pollEvents(currFileList map[string]os.FileInfo) {
+// WatchList returns the sorted names being watched.
+func (w *Watcher) WatchList() []string {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	created := make(map[string]os.FileInfo)
-	removed := make(map[string]os.FileInfo)
-
-	for latestFp, latestFi := range w.files {
-		// 1. if not found in files -> removed
-		if _, ok := currFileList[latestFp]; !ok {
-			removed[latestFp] = latestFi
-		}
+	names := make([]string, 0, len(w.names))
+	for name := range w.names {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	for fp, currFi := range currFileList {
-		latestFi, ok := w.files[fp]
-		if !ok {
-			// 2. if not found in currFileList -> created
-			created[fp] = currFi
-			continue
-		}
-		// 3. if ModTime + Size changes -> modify
-		if !latestFi.ModTime().Equal(currFi.ModTime()) || latestFi.Size() != currFi.Size() {
-			select {
-			case <-w.closed:
-				return
-			case w.Events <- Event{
-				Path:     fp,
-				Op:       Modify,
-				FileInfo: currFi,
-			}:
-			}
-		}
+// Files returns a copy of the files currently tracked by the watcher.
+func (w *Watcher) Files() map[string]os.FileInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := make(map[string]os.FileInfo, len(w.files))
+	for fp, fi := range w.files {
+		files[fp] = unwrapFileInfo(fi)
 	}
+	return files
+}
 
-	for removeFp, removeFi := range removed {
-		for createFp, createFi := range created {
-			// 4. if removed file becomes created file -> move
-			if os.SameFile(removeFi, createFi) {
-				ev := Event{
-					Path:     removeFp,
-					Op:       Move,
-					FileInfo: removeFi,
-				}
-				if filepath.Dir(removeFp) == filepath.Dir(createFp) {
-					ev.Op = Rename
-				}
-				delete(removed, removeFp)
-				delete(created, createFp)
-				select {
-				case <-w.closed:
-					return
-				case w.Events <- ev:
-				}
-			}
+// FilterOps restricts delivered events to the given ops, calling it
+// without ops restores all of them.
+func (w *Watcher) FilterOps(ops ...Op) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-		}
+	w.ops = 0
+	for _, op := range ops {
+		w.ops |= op
 	}
+}
 
-	for fp, fi := range created {
-		select {
-		case <-w.closed:
-			return
-		case w.Events <- Event{Path: fp, Op: Create, FileInfo: fi}:
+// Ignore leaves out entries whose base name or full path matches any of
+// the filepath.Match patterns, starting with the next poll.
+func (w *Watcher) Ignore(patterns ...string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pattern %s with error %w", pattern, err)
 		}
 	}
-	for fp, fi := range removed {
-		select {
-		case <-w.closed:
-			return
-		case w.Events <- Event{Path: fp, Op: Remove, FileInfo: fi}:
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// copied, as listing reads the patterns without holding the lock
+	var ignores []string
+	if old := w.ignores.Load(); old != nil {
+		ignores = append(ignores, *old...)
+	}
+	ignores = append(ignores, patterns...)
+	w.ignores.Store(&ignores)
+
+	// forget what is now ignored so it isn't reported as removed
+	for fp := range w.files {
+		if _, ok := w.names[fp]; !ok && w.skip(fp) {
+			delete(w.files, fp)
 		}
 	}
+	return nil
 }
 
-func (w *Watcher) doRemove(name string) {
-	delete(w.names, name)
+func (w *Watcher) ClearFilter() {
+	w.FilterOps()
+}
 
-	fi, ok := w.files[name]
-	if !ok {
-		return // check if it's still exist
+// SetFilter replaces the filter set by WithFilter, nil delivers all events.
+func (w *Watcher) SetFilter(fn func(Event) bool) {
+	if fn == nil {
+		w.filter.Store(nil)
+		return
 	}
+	w.filter.Store(&fn)
+}
 
-	delete(w.files, name)
+// Mute stops reporting the events for prefix and anything under it until
+// Unmute, while the other paths keep being reported.
+func (w *Watcher) Mute(prefix string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	if !fi.IsDir() {
-		return
+	w.muted[w.normalize(prefix)] = struct{}{}
+}
+
+// Unmute reports the events for prefix again, see Mute.
+func (w *Watcher) Unmute(prefix string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.muted, w.normalize(prefix))
+}
+
+// SetInterval changes the poll interval of a running watcher.
+func (w *Watcher) SetInterval(d time.Duration) error {
+	if d <= 0 {
+		return ErrInvalidInterval
+	}
+	if w.IsClosed() {
+		return ErrWatcherClosed
 	}
 
-	for fp := range w.files {
-		if filepath.Dir(fp) == name {
-			delete(w.files, fp)
-		}
+	w.interval.Store(d)
+	select {
+	case w.resetInterval <- struct{}{}:
+	default: // a reset is already pending
 	}
+	return nil
 }
 
-func (w *Watcher) listForAll() map[string]os.FileInfo {
+// RemoveAll stops watching every name, the watcher keeps running.
+func (w *Watcher) RemoveAll() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	fileList := make(map[string]os.FileInfo)
-	for name := range w.names {
-		fl, err := listForName(name)
-		if err != nil {
-			if os.IsNotExist(err) {
-				w.doRemove(name)
+	select {
+	case <-w.closed:
+		return ErrWatcherClosed
+	default:
+	}
+
+	w.names = make(map[string]*nameOptions)
+	w.aliases = make(map[string]string)
+	w.files = make(map[string]os.FileInfo)
+	w.misses = make(map[string]int)
+	w.replaced = make(map[string]struct{})
+	w.resetDeferred()
+	w.pending = nil
+	w.batch = nil
+	return nil
+}
+
+// resetDeferred forgets the events held back for a later poll.
+func (w *Watcher) resetDeferred() {
+	w.debounced = make(map[string]debouncedEvent)
+	w.held = make(map[string]debouncedEvent)
+	w.windows = make(map[string]debouncedEvent)
+	w.unstable = make(map[string]stableEvent)
+}
+
+func (w *Watcher) doWatch() {
+	ticker := w.clock.NewTicker(w.nextInterval())
+	defer ticker.Stop()
+	initial := w.initialScan
+	slow := false // warned that polls take longer than the interval
+	close(w.started)
+	for {
+		select {
+		case <-w.closed:
+			if w.drainOnClose {
+				w.pollMu.Lock()
+				w.draining = true // under pollMu, a PollNow may be running
+				w.pollLocked()
+				w.pollMu.Unlock()
 			}
-			select {
-			case <-w.closed:
-				return nil
-			case w.Errors <- err: // report on error if not exist
+			return
+		case <-w.resetInterval:
+			ticker.Reset(w.nextInterval())
+		case <-ticker.C():
+			if initial {
+				// forget the files seeded by Add so they're all reported as created
+				w.mu.Lock()
+				w.files = make(map[string]os.FileInfo)
+				w.mu.Unlock()
+				initial = false
+			}
+			w.poll()
+			w.lastPoll.Store(w.clock.Now())
+			if took, d := w.lastPollTook.Load(), w.interval.Load(); took > d {
+				if !slow {
+					w.logger.Printf("poll took %s, longer than the %s interval", took, d)
+				}
+				slow = true
+			} else {
+				slow = false
+			}
+			if w.jitter > 0 || w.errorBackoff > 0 {
+				ticker.Reset(w.nextInterval())
 			}
-		}
-		for fp, fi := range fl {
-			fileList[fp] = fi
 		}
 	}
-	return fileList
 }
 
-func listForName(name string) (map[string]os.FileInfo, error) {
-	stat, err := os.Stat(name)
-	if err != nil {
-		return nil, fmt.Errorf("name %s with error %v", name, err)
+// nextInterval returns how long to wait for the next poll, see
+// WithPollJitter and WithErrorBackoff.
+func (w *Watcher) nextInterval() time.Duration {
+	d := w.interval.Load()
+	for i := int32(0); i < w.failures.Load() && d < w.errorBackoff; i++ {
+		d *= 2
+		if d > w.errorBackoff {
+			d = w.errorBackoff
+		}
 	}
-
-	list := make(map[string]os.FileInfo)
-	list[name] = stat
-
-	if !stat.IsDir() {
-		// not a directory, return
-		return list, nil
+	if w.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * w.jitter * float64(d))
 	}
+	return d
+}
 
-	dirEntries, err := os.ReadDir(name)
-	if err != nil {
-		return nil, fmt.Errorf("directory %s with error %v", name, err)
-	}
+// PollNow runs a poll cycle synchronously instead of waiting for the next
+// tick. It is safe to call while the watcher is running, cycles never overlap.
+func (w *Watcher) PollNow() error {
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
 
-	for _, dirEntry := range dirEntries {
-		fp := filepath.Join(name, dirEntry.Name())
-		list[fp], _ = dirEntry.Info()
+	// checked under pollMu, which finishClose takes before closing channels
+	if w.IsClosed() {
+		return ErrWatcherClosed
 	}
+	w.pollLocked()
+	return nil
+}
+
+// poll lists all watched names and reports what changed since the last poll.
+func (w *Watcher) poll() {
+	w.pollMu.Lock()
+	defer w.pollMu.Unlock()
+
+	w.pollLocked()
+}
+
+// pollLocked is poll with pollMu held.
+func (w *Watcher) pollLocked() {
+	start := time.Now()
+	dropped := w.dropped.Load()
+	currFileList := w.listForAll()
+	w.pollEvents(currFileList)
+	w.mu.Lock()
+	w.files = currFileList
+	called := w.called
+	w.called = nil
+	w.mu.Unlock()
+
+	// without holding mu, so the callbacks can use the watcher
+	for _, ev := range called {
+		w.onEvent(ev)
+	}
+	if n := w.dropped.Load() - dropped; n > 0 {
+		w.sendError(&OverflowError{Dropped: n})
+	}
+
+	w.polls.Inc()
+	w.lastPollTook.Store(time.Since(start))
+}
+
+func (w *Watcher) Stats() Stats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	events := make(map[Op]uint64, len(w.opCounts))
+	for op, n := range w.opCounts {
+		events[op] = n
+	}
+	return Stats{
+		Polls:            w.polls.Load(),
+		Events:           events,
+		Errors:           w.errCount.Load(),
+		LastPollDuration: w.lastPollTook.Load(),
+		Files:            len(w.files),
+	}
+}
+
+// History returns a copy of the latest events emitted, oldest first, see
+// WithHistory.
+func (w *Watcher) History() []Event {
+	w.historyMu.Lock()
+	defer w.historyMu.Unlock()
+
+	history := make([]Event, 0, len(w.history))
+	history = append(history, w.history[w.historyNext:]...)
+	return append(history, w.history[:w.historyNext]...)
+}
+
+func (w *Watcher) record(ev Event) {
+	if w.historySize <= 0 {
+		return
+	}
+	w.historyMu.Lock()
+	defer w.historyMu.Unlock()
+
+	if len(w.history) < w.historySize {
+		w.history = append(w.history, ev)
+		return
+	}
+	w.history[w.historyNext] = ev
+	w.historyNext = (w.historyNext + 1) % w.historySize
+}
+
+func (w *Watcher) pollEvents(currFileList map[string]os.FileInfo) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.paused.Load() {
+		// the caller still takes currFileList, so nothing fires on resume
+		w.resetDeferred()
+		return
+	}
+
+	now := w.clock.Now()
+	d := differ{
+		now:             now,
+		ownership:       w.ownership,
+		caseInsensitive: w.caseInsensitive,
+		ignoreModTime:   w.ignoreModTime,
+		fingerprints:    w.fingerprints,
+		comparator:      w.comparator,
+	}
+	if w.appendDetection {
+		d.isAppend = w.isAppend
+	}
+	events := d.diff(w.files, currFileList)
+	if w.sortedEvents {
+		sort.Slice(events, func(i, j int) bool {
+			if events[i].Path != events[j].Path {
+				return events[i].Path < events[j].Path
+			}
+			return events[i].Op < events[j].Op
+		})
+	}
+
+	for fp := range w.debounced {
+		if _, ok := currFileList[fp]; !ok {
+			delete(w.debounced, fp)
+		}
+	}
+
+	changed := make(map[string]struct{}) // see WithStableModTime
+	for _, ev := range events {
+		if w.suppressDirModify && ev.IsDirEvent() {
+			if ev.Op &^= Modify; ev.Op == 0 {
+				continue
+			}
+		}
+		if w.stablePolls > 0 {
+			se, ok := w.unstable[ev.Path]
+			if ok && ev.Op&(Remove|Move|Rename) != 0 {
+				delete(w.unstable, ev.Path) // gone, the Modify doesn't matter
+			} else if ok || ev.Op&(Modify|Truncate|Append) != 0 && !ev.IsDirEvent() {
+				ev.Op |= se.ev.Op
+				w.unstable[ev.Path] = stableEvent{ev: ev}
+				changed[ev.Path] = struct{}{}
+				continue
+			}
+		}
+		if w.aggregate > 0 {
+			// the window starts with the first event
+			if we, ok := w.windows[ev.Path]; ok {
+				ev.Op |= we.ev.Op
+				w.windows[ev.Path] = debouncedEvent{ev: ev, lastSeen: we.lastSeen}
+			} else {
+				w.windows[ev.Path] = debouncedEvent{ev: ev, lastSeen: now}
+			}
+			continue
+		}
+		if w.coalesce > 0 {
+			if held, ok := w.held[ev.Path]; ok {
+				delete(w.held, ev.Path)
+				if ev.Op == Remove {
+					continue // short-lived, report neither
+				}
+				if !w.sendEvent(held.ev) {
+					return
+				}
+			}
+			if ev.Op == Create {
+				w.held[ev.Path] = debouncedEvent{ev: ev, lastSeen: now}
+				continue
+			}
+		}
+		if ev.Op&Modify != 0 && w.debounce > 0 {
+			if de, ok := w.debounced[ev.Path]; ok {
+				ev.Op |= de.ev.Op
+			}
+			w.debounced[ev.Path] = debouncedEvent{ev: ev, lastSeen: now}
+			continue
+		}
+		if !w.sendEvent(ev) {
+			return
+		}
+	}
+
+	// 7. emit debounced events that have been quiet long enough
+	for fp, de := range w.debounced {
+		if now.Sub(de.lastSeen) < w.debounce && !w.draining {
+			continue
+		}
+		delete(w.debounced, fp)
+		if !w.sendEvent(de.ev) {
+			return
+		}
+	}
+
+	// 7b. emit events of files left unchanged for WithStableModTime polls
+	for fp, se := range w.unstable {
+		if !w.draining {
+			if _, ok := changed[fp]; ok {
+				continue
+			}
+			if se.polls++; se.polls < w.stablePolls {
+				w.unstable[fp] = se
+				continue
+			}
+		}
+		delete(w.unstable, fp)
+		if !w.sendEvent(se.ev) {
+			return
+		}
+	}
+
+	// 8. emit held Create events that outlived WithCoalesceShortLived
+	for fp, he := range w.held {
+		if now.Sub(he.lastSeen) < w.coalesce && !w.draining {
+			continue
+		}
+		delete(w.held, fp)
+		if !w.sendEvent(he.ev) {
+			return
+		}
+	}
+
+	// 8b. emit events whose WithAggregateWindow is over
+	for fp, we := range w.windows {
+		if now.Sub(we.lastSeen) < w.aggregate && !w.draining {
+			continue
+		}
+		delete(w.windows, fp)
+		if !w.sendEvent(we.ev) {
+			return
+		}
+	}
+
+	// 9. deliver the events collected as a whole, see WithBatchEvents
+	if len(w.batch) > 0 {
+		batch := w.batch
+		w.batch = nil
+		if !w.sendBatch(batch) {
+			return
+		}
+	}
+}
+
+// sendBatch is sendEvent for the batches of WithBatchEvents.
+func (w *Watcher) sendBatch(batch []Event) bool {
+	if w.draining {
+		select {
+		case w.Batches <- batch:
+		default:
+			w.pending = append(w.pending, batch...)
+		}
+		return true
+	}
+	if w.nonBlocking {
+		select {
+		case w.Batches <- batch:
+		default:
+			w.dropped.Add(uint64(len(batch)))
+		}
+		return true
+	}
+	select {
+	case <-w.closed:
+		if w.drainOnClose {
+			w.draining = true
+			w.pending = append(w.pending, batch...)
+			return true
+		}
+		return false
+	case w.Batches <- batch:
+		return true
+	}
+}
+
+// sendEvent delivers ev unless its op is filtered out, it returns false
+// once the watcher is closed. w.mu must be held.
+func (w *Watcher) sendEvent(ev Event) bool {
+	if w.ops != 0 && ev.Op&w.ops == 0 {
+		return true
+	}
+	ev.FileInfo = unwrapFileInfo(ev.FileInfo)
+	if filter := w.filter.Load(); filter != nil && !(*filter)(ev) {
+		return true
+	}
+	for name, o := range w.names {
+		if o.filter != nil && covers(name, o, ev.Path) && !o.filter(ev) {
+			return true
+		}
+	}
+	for prefix := range w.muted {
+		if isUnder(ev.Path, prefix) {
+			return true
+		}
+	}
+	ev.Seq = w.seq.Inc()
+	w.record(ev)
+	for _, op := range allOps {
+		if ev.Op&op != 0 {
+			w.opCounts[op]++
+		}
+	}
+	w.publish(ev)
+	if w.batchEvents {
+		w.batch = append(w.batch, ev)
+		return true
+	}
+	if w.onEvent != nil {
+		w.called = append(w.called, ev)
+		return true
+	}
+	if w.draining {
+		select {
+		case w.Events <- ev:
+		default:
+			w.pending = append(w.pending, ev)
+		}
+		return true
+	}
+	if w.nonBlocking {
+		select {
+		case w.Events <- ev:
+		default:
+			w.dropped.Inc()
+		}
+		return true
+	}
+	select {
+	case <-w.closed:
+		if w.drainOnClose {
+			// closed while sending, keep the rest like the poll run on Close
+			w.draining = true
+			w.pending = append(w.pending, ev)
+			return true
+		}
+		return false
+	case w.Events <- ev:
+		return true
+	}
+}
+
+// doRemove stops watching name along with the files under it, except
+// those other watched names still cover, e.g. an added subdirectory. For a
+// pattern, that's the files under the paths it matched.
+func (w *Watcher) doRemove(name string) {
+	delete(w.names, name)
+	delete(w.misses, name)
+	delete(w.replaced, name)
+
+	roots := []string{name}
+	if isPattern(name) {
+		roots = roots[:0]
+		for fp := range w.files {
+			if ok, _ := filepath.Match(name, fp); ok {
+				roots = append(roots, fp)
+			}
+		}
+	}
+
+	for _, root := range roots {
+		removed := func(fp string) bool {
+			return isUnder(fp, root) && !w.covered(fp)
+		}
+		for fp := range w.files {
+			if removed(fp) {
+				delete(w.files, fp)
+			}
+		}
+		// and the events held back for them
+		for fp := range w.debounced {
+			if removed(fp) {
+				delete(w.debounced, fp)
+			}
+		}
+		for fp := range w.held {
+			if removed(fp) {
+				delete(w.held, fp)
+			}
+		}
+		for fp := range w.windows {
+			if removed(fp) {
+				delete(w.windows, fp)
+			}
+		}
+		for fp := range w.unstable {
+			if removed(fp) {
+				delete(w.unstable, fp)
+			}
+		}
+	}
+}
+
+// covered reports whether fp is listed for any watched name.
+func (w *Watcher) covered(fp string) bool {
+	for name, o := range w.names {
+		if covers(name, o, fp) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether listing name with o includes fp.
+func covers(name string, o *nameOptions, fp string) bool {
+	root := name
+	if isPattern(name) {
+		// the closest of fp and its parents the pattern matches
+		for root = fp; ; {
+			if ok, _ := filepath.Match(name, root); ok {
+				break
+			}
+			parent := filepath.Dir(root)
+			if parent == root {
+				return false
+			}
+			root = parent
+		}
+	}
+	if !isUnder(fp, root) {
+		return false
+	}
+	if fp == root {
+		return true
+	}
+	rel, err := filepath.Rel(root, fp)
+	if err != nil {
+		return false
+	}
+	return strings.Count(rel, string(filepath.Separator)) <= o.maxDepth && !matchAny(o.ignores, fp)
+}
+
+func (w *Watcher) listForAll() map[string]os.FileInfo {
+	// list without holding the lock, until every watched name is listed
+	// in case some were added meanwhile
+	listed := make(map[string]listResult)
+	for {
+		w.mu.Lock()
+		var names []string
+		var opts []*nameOptions
+		for name, o := range w.names {
+			if _, ok := listed[name]; !ok {
+				names = append(names, name)
+				opts = append(opts, o)
+			}
+		}
+		if len(names) == 0 {
+			break
+		}
+		w.mu.Unlock()
+
+		for i, result := range w.listNames(names, opts) {
+			listed[names[i]] = result
+		}
+	}
+
+	fileList := make(map[string]os.FileInfo)
+	var errs []error
+	failed := false
+	for name, result := range listed {
+		if _, ok := w.names[name]; !ok {
+			continue // removed meanwhile
+		}
+		if err := result.err; err != nil {
+			if w.isReplacing(name, err) {
+				// assume it's mid-replace, keep it as it was for now
+				w.misses[name]++
+				if fi, ok := w.files[name]; ok {
+					fileList[name] = fi
+				}
+				continue
+			}
+			failed = true
+			if errors.Is(err, fs.ErrNotExist) {
+				w.misses[name]++
+				if w.autoReAdd && w.misses[name] > 1 {
+					continue // already reported, keep waiting for it
+				}
+				if !w.autoReAdd && w.misses[name] >= w.missingRetries {
+					// stop watching, but keep its files so the diff
+					// against them reports it as removed
+					delete(w.names, name)
+					delete(w.misses, name)
+				} else if !w.autoReAdd {
+					// keep its files until it's dropped, so it coming
+					// back isn't reported as removed and created
+					for fp, fi := range w.files {
+						if covers(name, w.names[name], fp) {
+							fileList[fp] = fi
+						}
+					}
+				}
+			}
+			if w.isDuplicateError(name, err) {
+				continue
+			}
+			errs = append(errs, &WatchError{Watcher: w.name, Name: name, Err: err})
+			continue
+		}
+		delete(w.misses, name)
+		for fp, fi := range result.files {
+			fileList[fp] = fi
+		}
+		for _, err := range result.errs {
+			failed = true
+			if !w.isDuplicateError(name, err) {
+				errs = append(errs, &WatchError{Watcher: w.name, Name: name, Err: err})
+			}
+		}
+	}
+	if total := len(fileList); w.capFiles(fileList) {
+		failed = true
+		errs = append(errs, fmt.Errorf("%w, watching %d of %d", ErrTooManyFiles, w.maxFiles, total))
+	}
+	if failed {
+		w.failures.Inc()
+	} else {
+		w.failures.Store(0)
+	}
+	w.mu.Unlock()
+
+	// report errors without holding the lock, so a slow consumer
+	// doesn't block Add/Remove
+	for _, err := range errs {
+		if !w.sendError(err) {
+			return nil
+		}
+	}
+	return fileList
+}
+
+// capFiles leaves out the files past the first w.maxFiles in path order,
+// it reports whether it had to, see WithMaxFiles.
+func (w *Watcher) capFiles(files map[string]os.FileInfo) bool {
+	if w.maxFiles <= 0 || len(files) <= w.maxFiles {
+		return false
+	}
+	for _, fp := range sortedKeys(files)[w.maxFiles:] {
+		delete(files, fp)
+	}
+	return true
+}
+
+// isReplacing reports whether the file name, missing with err, may be in
+// the middle of being replaced, see WithWatchParentForFiles. w.mu must be
+// held, so the parent is stat'ed once rather than through retry.
+func (w *Watcher) isReplacing(name string, err error) bool {
+	if _, ok := w.replaced[name]; !ok || w.misses[name] > 0 || !errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	parent, err := w.fs.Stat(filepath.Dir(name))
+	return err == nil && parent.IsDir()
+}
+
+// isDuplicateError reports whether err was already reported for name within
+// the dedup window, recording it otherwise. w.mu must be held.
+func (w *Watcher) isDuplicateError(name string, err error) bool {
+	if w.errorDedup <= 0 {
+		return false
+	}
+
+	now := w.clock.Now()
+	for key, sent := range w.errSent {
+		if now.Sub(sent) >= w.errorDedup {
+			delete(w.errSent, key)
+		}
+	}
+
+	key := name + "\x00" + err.Error()
+	if _, ok := w.errSent[key]; ok {
+		return true
+	}
+	w.errSent[key] = now
+	return false
+}
+
+type listResult struct {
+	*listing
+	err error
+}
+
+// listNames lists names with their options with up to w.concurrency
+// goroutines.
+func (w *Watcher) listNames(names []string, opts []*nameOptions) []listResult {
+	results := make([]listResult, len(names))
+	workers := w.concurrency
+	if workers > len(names) {
+		workers = len(names)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				l, err := w.listForName(names[i], opts[i])
+				results[i] = listResult{listing: l, err: err}
+			}
+		}()
+	}
+	for i := range names {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// sendError delivers err, it returns false once the watcher is closed.
+func (w *Watcher) sendError(err error) bool {
+	w.errCount.Inc()
+	if w.onError != nil {
+		w.onError(err)
+		return true
+	}
+	if w.draining || w.nonBlocking {
+		select {
+		case w.Errors <- err:
+		default: // dropped
+		}
+		return true
+	}
+	select {
+	case <-w.closed:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
+
+// listing accumulates what is found while listing a watched name.
+type listing struct {
+	opts    *nameOptions
+	files   map[string]os.FileInfo
+	errs    []error             // entries left out as they couldn't be listed
+	visited map[fileID]struct{} // directories listed, see WithFollowSymlinks
+}
+
+func newListing(o *nameOptions) *listing {
+	return &listing{
+		opts:    o,
+		files:   make(map[string]os.FileInfo),
+		visited: make(map[fileID]struct{}),
+	}
+}
+
+func (w *Watcher) listForName(name string, o *nameOptions) (*listing, error) {
+	l := newListing(o)
+	if !isPattern(name) {
+		if err := w.listForPath(l, name); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	matches, err := w.fs.Glob(name)
+	if err != nil {
+		return nil, fmt.Errorf("pattern %s with error %w", name, err)
+	}
+
+	// an empty match set is not an error, the pattern is re-evaluated on each poll
+	for _, match := range matches {
+		if w.skip(match) || matchAny(o.ignores, match) {
+			continue
+		}
+		if err := w.listForPath(l, match); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // removed between Glob and Stat
+			}
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (w *Watcher) listForPath(l *listing, name string) error {
+	// a watched name is resolved whether or not the entries found under it
+	// are, see WithFollowSymlinks
+	var stat os.FileInfo
+	err := w.retry(func() (err error) {
+		stat, err = w.fs.Stat(name)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("name %s with error %w", name, err)
+	}
+
+	fi := w.fileInfo(name, stat)
+	if lstat, err := w.fs.Lstat(name); err == nil && lstat.Mode()&fs.ModeSymlink != 0 {
+		// so pointing it elsewhere is reported
+		fi.(*fileInfo).target, _ = w.fs.Readlink(name)
+	}
+	l.files[name] = fi
+
+	if !stat.IsDir() {
+		// not a directory, return
+		return nil
+	}
+
+	w.visit(l, stat)
+	return w.listDir(l, name, 0)
+}
+
+// listDir adds the entries of dir to l, descending into subdirectories
+// while depth is below the name's maxDepth.
+func (w *Watcher) listDir(l *listing, dir string, depth int) error {
+	return w.readDir(l, dir, func(dirEntries []fs.DirEntry) error {
+		for _, dirEntry := range dirEntries {
+			if err := w.listEntry(l, dir, dirEntry, depth); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readDir calls fn with the entries of dir, readDirChunk at a time where
+// the filesystem supports it so huge directories aren't read whole. The
+// directory is read again from the start on read errors, see
+// WithReadRetries. The errors of fn are returned as is.
+func (w *Watcher) readDir(l *listing, dir string, fn func([]fs.DirEntry) error) error {
+	var fnErr error
+	errs := len(l.errs)
+	read := false
+	err := w.retry(func() error {
+		if read {
+			// drop what the failed read added, it's listed again
+			l.errs = l.errs[:errs]
+			for fp, fi := range l.files {
+				if fp == dir || !isUnder(fp, dir) {
+					continue
+				}
+				if id, ok := fileIDOf(fi); ok && fi.IsDir() {
+					delete(l.visited, id)
+				}
+				delete(l.files, fp)
+			}
+		}
+		read = true
+		err := w.fs.ReadDirChunks(dir, readDirChunk, func(dirEntries []fs.DirEntry) error {
+			fnErr = fn(dirEntries)
+			return fnErr
+		})
+		if fnErr != nil {
+			return nil // not a read error, don't retry
+		}
+		return err
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("directory %s with error %w", dir, err)
+	}
+	return nil
+}
+
+// listEntry adds dirEntry of dir to l, and what's under it within depth.
+func (w *Watcher) listEntry(l *listing, dir string, dirEntry fs.DirEntry, depth int) error {
+	fp := filepath.Join(dir, dirEntry.Name())
+	if w.skip(fp) || matchAny(l.opts.ignores, fp) {
+		return nil
+	}
+	fi, err := dirEntry.Info()
+	if err != nil {
+		w.logger.Printf("entry %s with error %v", fp, err)
+	}
+	if err != nil || (w.followSymlinks && dirEntry.Type()&fs.ModeSymlink != 0) {
+		// the entry may not carry its info, or it's a link to resolve
+		if stat, statErr := w.stat(fp); statErr == nil {
+			fi, err = stat, nil
+		}
+	}
+	if err != nil {
+		// leave it out rather than track it without info
+		l.errs = append(l.errs, fmt.Errorf("entry %s with error %w", fp, err))
+		return nil
+	}
+	l.files[fp] = w.fileInfo(fp, fi)
+	if !fi.IsDir() || depth >= l.opts.maxDepth || !w.visit(l, fi) {
+		return nil
+	}
+	if err := w.listDir(l, fp, depth+1); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // removed while listing
+		}
+		return err
+	}
+	return nil
+}
+
+// stat resolves name, following a symlink only with WithFollowSymlinks.
+func (w *Watcher) stat(name string) (fi os.FileInfo, err error) {
+	err = w.retry(func() error {
+		if w.followSymlinks {
+			fi, err = w.fs.Stat(name)
+		} else {
+			fi, err = w.fs.Lstat(name)
+		}
+		return err
+	})
+	return fi, err
+}
+
+// retry calls fn again while it fails with anything but a missing file,
+// see WithReadRetries.
+func (w *Watcher) retry(fn func() error) error {
+	err := fn()
+	for i := 0; err != nil && i < w.readRetries && !errors.Is(err, fs.ErrNotExist); i++ {
+		time.Sleep(w.readBackoff << i)
+		err = fn()
+	}
+	return err
+}
+
+// visit records the directory fi as listed in l, it returns false if it
+// was already listed through another path while following symlinks.
+func (w *Watcher) visit(l *listing, fi os.FileInfo) bool {
+	if !w.followSymlinks {
+		return true
+	}
+	id, ok := fileIDOf(fi)
+	if !ok {
+		return true
+	}
+	if _, ok := l.visited[id]; ok {
+		return false
+	}
+	l.visited[id] = struct{}{}
+	return true
+}
+
+// skip reports whether path should be left out of the listing.
+func (w *Watcher) skip(path string) bool {
+	base := filepath.Base(path)
+	if w.ignoreHidden && strings.HasPrefix(base, ".") {
+		return true
+	}
+	ignores := w.ignores.Load()
+	return ignores != nil && matchAny(*ignores, path)
+}
+
+// matchAny reports whether the base name or full path of path matches any
+// of the filepath.Match patterns.
+func matchAny(patterns []string, path string) bool {
+	base := filepath.Base(path)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fileInfo wraps fi with its file ID and, when content hashing or
+// fingerprinting is enabled, checksums of its content.
+func (w *Watcher) fileInfo(name string, fi os.FileInfo) os.FileInfo {
+	if fi == nil {
+		return nil
+	}
+
+	f := &fileInfo{FileInfo: fi}
+	f.id, f.hasID = fileIDOf(fi)
+	if w.contentHash && fi.Mode().IsRegular() && fi.Size() <= maxHashSize {
+		f.hash, _ = w.hashFile(name, -1) // nil falls back to ModTime + Size
+	}
+	if w.fingerprints && fi.Mode().IsRegular() && fi.Size() > 0 {
+		n := fi.Size()
+		if n > fingerprintSize {
+			n = fingerprintSize
+		}
+		f.print, _ = w.hashFile(name, n)
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		f.target, _ = w.fs.Readlink(name)
+	}
+	return f
+}
 
-	return list, nil
+// hashFile checksums the first n bytes of name, all of it if n is negative.
+func (w *Watcher) hashFile(name string, n int64) ([]byte, error) {
+	f, err := w.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if n < 0 {
+		_, err = io.Copy(h, f)
+	} else {
+		_, err = io.CopyN(h, f, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// isAppend reports whether the file at name still starts with the content
+// latest was hashed from, see WithAppendDetection. Without a checksum to
+// compare, growing is taken as appending.
+func (w *Watcher) isAppend(name string, latest os.FileInfo) bool {
+	hash := hashOf(latest)
+	if hash == nil {
+		return true
+	}
+	prefix, err := w.hashFile(name, latest.Size())
+	return err == nil && bytes.Equal(prefix, hash)
+}
+
+// isUnder reports whether path is dir or inside it, "/a/foobar" isn't
+// under "/a/foo".
+func isUnder(path, dir string) bool {
+	path, dir = filepath.Clean(path), filepath.Clean(dir)
+	if path == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator) // a root ends with one already
+	}
+	return strings.HasPrefix(path, dir)
+}
+
+// isPattern reports whether name contains any of the magic characters
+// recognized by filepath.Match.
+func isPattern(name string) bool {
+	magic := `*?[`
+	if runtime.GOOS != "windows" {
+		magic = `*?[\`
+	}
+	return strings.ContainsAny(name, magic)
 }
@@ -1,11 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestWatcher(t *testing.T) {
@@ -22,15 +34,17 @@ func TestWatcher(t *testing.T) {
 	oldFilePath = filepath.Join(dir, oldFileName)
 	newFilePath = filepath.Join(dir, newFileName)
 
+	f, err := os.Create(oldFilePath)
+	require.NoError(t, err)
+	f.Close()
+
 	w := NewWatcher()
 	defer w.Close()
 
-	err := w.Add(dir)
+	err = w.Add(dir)
 	require.NoError(t, err)
-
-	f, err := os.Create(oldFilePath)
+	err = w.Start(10 * time.Millisecond)
 	require.NoError(t, err)
-	_ := f.Close()
 
 	// assert and wait for Rename
 	wg.Add(1)
@@ -75,7 +89,7 @@ func TestWatcher(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		assertEvent(w, oldFilePath, Move, t)
+		assertEvent(t, w, oldFilePath, Move)
 	}()
 
 	err = os.Rename(oldFilePath, oldFilePath2)
@@ -83,20 +97,3268 @@ func TestWatcher(t *testing.T) {
 	wg.Wait()
 }
 
-func assertEvent(t *testing.T, w *Watcher, path string, op Op) {
-	t.Helper()
-	for {
-		select {
-		case ev := <-w.Events:
-			if ev.IsDirEvent() {
-				continue
+func TestWatcherRenameNewPath(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	oldFilePath := filepath.Join(dir, "xxx")
+	newFilePath := filepath.Join(dir, "yyy")
+	f, err := os.Create(oldFilePath)
+	require.NoError(t, err)
+	f.Close()
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = os.Rename(oldFilePath, newFilePath)
+	require.NoError(t, err)
+	ev := nextEvent(t, w)
+	require.True(t, ev.HasOps(Rename))
+	require.Equal(t, oldFilePath, ev.Path)
+	require.Equal(t, newFilePath, ev.NewPath)
+}
+
+func TestWatcherOnEvent(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	events := make(chan Event, 10)
+	w.OnEvent(func(ev Event) {
+		if !ev.IsDirEvent() {
+			events <- ev
+		}
+	})
+	w.OnError(func(err error) {
+		t.Error(err)
+	})
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	select {
+	case ev := <-events:
+		require.True(t, ev.HasOps(Create))
+		require.Equal(t, filePath, ev.Path)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for callback")
+	}
+}
+
+func TestWatcherOnEventReentrant(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys))
+	defer w.Close()
+
+	var files map[string]os.FileInfo
+	w.OnEvent(func(ev Event) {
+		// the watcher isn't locked while calling back
+		files = w.Files()
+		w.Mute(ev.Path)
+	})
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/xxx"] = &fstest.MapFile{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.poll()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deadlocked calling the watcher from OnEvent")
+	}
+	require.Contains(t, files, "dir/xxx")
+}
+
+func TestWatcherMoveAcrossDirs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("device and inode numbers are checked on linux")
+	}
+
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+	dir2, _ := os.MkdirTemp("", "test2")
+	defer os.RemoveAll(dir2)
+
+	oldFilePath := filepath.Join(dir, "xxx")
+	newFilePath := filepath.Join(dir2, "yyy")
+	err := os.WriteFile(oldFilePath, nil, 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.AddAll(dir, dir2)
+	require.NoError(t, err)
+
+	err = os.Rename(oldFilePath, newFilePath)
+	require.NoError(t, err)
+	w.poll()
+
+	ev := nextEvent(t, w)
+	require.Equal(t, Move, ev.Op)
+	require.Equal(t, oldFilePath, ev.Path)
+	require.Equal(t, newFilePath, ev.NewPath)
+}
+
+func TestWatcherSwap(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("device and inode numbers are checked on linux")
+	}
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	aPath, bPath, tmpPath := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "tmp")
+	require.NoError(t, os.WriteFile(aPath, []byte("aaa"), 0644))
+	require.NoError(t, os.WriteFile(bPath, []byte("bbb"), 0644))
+
+	w := NewWatcher(WithSuppressDirModify(), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Rename(aPath, tmpPath))
+	require.NoError(t, os.Rename(bPath, aPath))
+	require.NoError(t, os.Rename(tmpPath, bPath))
+	w.poll()
+
+	got := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		ev := nextEvent(t, w)
+		require.Equal(t, Rename, ev.Op)
+		got[ev.Path] = ev.NewPath
+	}
+	require.Equal(t, map[string]string{aPath: bPath, bPath: aPath}, got)
+	assertNoEvent(t, w, 50*time.Millisecond)
+}
+
+func TestWatcherMoveWithoutFileID(t *testing.T) {
+	modTime := time.Now()
+	fsys := fstest.MapFS{
+		"dir/xxx":  {Data: []byte("xxx"), ModTime: modTime},
+		"dir/yyy":  {},
+		"dir2/yyy": {},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.AddAll("dir", "dir2")
+	require.NoError(t, err)
+
+	fsys["dir2/xxx"] = fsys["dir/xxx"]
+	delete(fsys, "dir/xxx")
+	w.poll()
+
+	ev := nextEvent(t, w)
+	require.Equal(t, Move, ev.Op)
+	require.Equal(t, "dir/xxx", ev.Path)
+	require.Equal(t, "dir2/xxx", ev.NewPath)
+}
+
+func TestWatcherFingerprintMoves(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "a"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "b"), 0755))
+	oldPath, newPath := filepath.Join(dir, "a", "xxx"), filepath.Join(dir, "b", "xxx")
+	require.NoError(t, os.WriteFile(oldPath, []byte("hello"), 0644))
+
+	w := NewWatcher(WithMaxDepth(1), WithFingerprintMoves(), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	// copied, so it's another inode
+	require.NoError(t, os.WriteFile(newPath, []byte("hello"), 0644))
+	require.NoError(t, os.Remove(oldPath))
+	w.poll()
+
+	ev := nextEvent(t, w)
+	require.Equal(t, Move, ev.Op)
+	require.Equal(t, oldPath, ev.Path)
+	require.Equal(t, newPath, ev.NewPath)
+}
+
+func TestWatcherClose(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Close()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Close")
+	}
+
+	_, ok := <-w.Events
+	require.False(t, ok)
+	_, ok = <-w.Errors
+	require.False(t, ok)
+
+	// closing twice is a no-op
+	w.Close()
+}
+
+func TestWatcherClosedState(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	for name, start := range map[string]bool{"idle": false, "running": true} {
+		t.Run(name, func(t *testing.T) {
+			w := NewWatcher()
+			err := w.Add(dir)
+			require.NoError(t, err)
+			if start {
+				err = w.Start(10 * time.Millisecond)
+				require.NoError(t, err)
+				err = w.Start(10 * time.Millisecond)
+				require.Equal(t, ErrWatcherStarted, err)
 			}
-			require.True(t, ev.HasOps(op))
-			require.Equal(t, path, ev.Path)
-			return
-		case err := <-w.Errors:
-			t.Fatal(err)
-			return
+			w.Close()
+
+			err = w.Start(10 * time.Millisecond)
+			require.Equal(t, ErrWatcherClosed, err)
+			err = w.Start(0)
+			require.Equal(t, ErrWatcherClosed, err)
+			err = w.StartContext(context.Background(), 10*time.Millisecond)
+			require.Equal(t, ErrWatcherClosed, err)
+			err = w.Add(dir)
+			require.Equal(t, ErrWatcherClosed, err)
+			err = w.AddAll(dir)
+			require.Equal(t, ErrWatcherClosed, err)
+			err = <-w.AddAsync(dir)
+			require.Equal(t, ErrWatcherClosed, err)
+			err = w.Remove(dir)
+			require.Equal(t, ErrWatcherClosed, err)
+		})
+	}
+}
+
+func TestWatcherStartCloseRace(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		fsys := fstest.MapFS{
+			"dir/xxx": {},
 		}
+		w := NewWatcher(WithFS(fsys), WithDrainOnClose())
+		err := w.Add("dir")
+		require.NoError(t, err)
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- w.Start(time.Millisecond)
+		}()
+		w.Close()
+		err = <-errc
+		require.True(t, err == nil || err == ErrWatcherClosed)
+		w.Wait()
+	}
+}
+
+func TestWatcherStatus(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	require.False(t, w.IsRunning())
+	require.False(t, w.IsClosed())
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, w.IsRunning())
+	require.False(t, w.IsClosed())
+
+	w.Close()
+	require.False(t, w.IsRunning())
+	require.True(t, w.IsClosed())
+}
+
+func TestWatcherSetInterval(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err := w.Start(0)
+	require.Equal(t, ErrInvalidInterval, err)
+	err = w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(time.Second)
+	require.NoError(t, err)
+
+	err = w.SetInterval(-time.Second)
+	require.Equal(t, ErrInvalidInterval, err)
+	err = w.SetInterval(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assertEvent(t, w, filePath, Create)
+	}()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timed out waiting for the faster poll")
+	}
+}
+
+func TestWatcherCoalesceShortLived(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithCoalesceShortLived(50*time.Millisecond), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/tmp"] = &fstest.MapFile{}
+	w.poll()
+	delete(fsys, "dir/tmp")
+	w.poll()
+	require.Empty(t, w.Events)
+
+	// a file outliving d is reported
+	fsys["dir/xxx"] = &fstest.MapFile{}
+	w.poll()
+	require.Empty(t, w.Events)
+	time.Sleep(60 * time.Millisecond)
+	w.poll()
+
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "dir/xxx", ev.Path)
+	require.Equal(t, Create, ev.Op)
+}
+
+func TestWatcherAggregateWindow(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithAggregateWindow(50*time.Millisecond), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/xxx"] = &fstest.MapFile{}
+	w.poll()
+	fsys["dir/xxx"] = &fstest.MapFile{Data: []byte("hello")}
+	w.poll()
+	require.Empty(t, w.Events)
+
+	time.Sleep(60 * time.Millisecond)
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "dir/xxx", ev.Path)
+	require.Equal(t, Create|Modify, ev.Op)
+}
+
+func TestWatcherStableModTime(t *testing.T) {
+	modTime := time.Now()
+	fsys := fstest.MapFS{
+		"dir/xxx": {Data: []byte("x"), ModTime: modTime},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithStableModTime(2), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	// still being written
+	for i := 1; i <= 3; i++ {
+		fsys["dir/xxx"] = &fstest.MapFile{Data: []byte("xxxx")[:i+1], ModTime: modTime.Add(time.Duration(i) * time.Second)}
+		w.poll()
+	}
+	require.Empty(t, w.Events)
+
+	w.poll()
+	require.Empty(t, w.Events)
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "dir/xxx", ev.Path)
+	require.Equal(t, Modify, ev.Op)
+
+	w.poll()
+	require.Empty(t, w.Events)
+}
+
+func TestWatcherFilesOnly(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), FilesOnly(), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/sub"] = &fstest.MapFile{Mode: fs.ModeDir}
+	fsys["dir/xxx"] = &fstest.MapFile{}
+	w.poll()
+
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "dir/xxx", ev.Path)
+	require.Equal(t, Create, ev.Op)
+}
+
+func TestWatcherDirsOnly(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), DirsOnly(), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/sub"] = &fstest.MapFile{Mode: fs.ModeDir}
+	fsys["dir/xxx"] = &fstest.MapFile{}
+	w.poll()
+
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "dir/sub", ev.Path)
+	require.Equal(t, Create, ev.Op)
+
+	// the filter can be lifted while watching
+	w.SetFilter(nil)
+	fsys["dir/yyy"] = &fstest.MapFile{}
+	w.poll()
+
+	require.Len(t, w.Events, 1)
+	ev = <-w.Events
+	require.Equal(t, "dir/yyy", ev.Path)
+}
+
+func TestWatcherMute(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/a": {Mode: fs.ModeDir},
+		"dir/b": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithMaxDepth(1), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	w.Mute("dir/a")
+	fsys["dir/a/xxx"] = &fstest.MapFile{}
+	fsys["dir/b/yyy"] = &fstest.MapFile{}
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "dir/b/yyy", ev.Path)
+
+	w.Unmute("dir/a")
+	fsys["dir/a/zzz"] = &fstest.MapFile{}
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev = <-w.Events
+	require.Equal(t, "dir/a/zzz", ev.Path)
+}
+
+func TestWatcherWatchExtensions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithMaxDepth(1), WatchExtensions("go", ".PROTO"), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/main.go"] = &fstest.MapFile{}
+	fsys["dir/api.proto"] = &fstest.MapFile{}
+	fsys["dir/notes.txt"] = &fstest.MapFile{}
+	fsys["dir/sub"] = &fstest.MapFile{Mode: fs.ModeDir}
+	w.poll()
+
+	var got []string
+	for len(w.Events) > 0 {
+		got = append(got, (<-w.Events).Path)
+	}
+	require.ElementsMatch(t, []string{"dir/main.go", "dir/api.proto", "dir/sub"}, got)
+}
+
+func TestWatcherSubscribe(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/a": {Mode: fs.ModeDir},
+		"dir/b": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithMaxDepth(1), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	subA, unsubA := w.Subscribe("dir/a")
+	subB, unsubB := w.Subscribe("dir/b")
+	defer unsubB()
+
+	fsys["dir/a/xxx"] = &fstest.MapFile{}
+	fsys["dir/b/yyy"] = &fstest.MapFile{}
+	fsys["dir/ab"] = &fstest.MapFile{}
+	w.poll()
+
+	require.Len(t, w.Events, 3)
+	require.Len(t, subA, 1)
+	require.Equal(t, "dir/a/xxx", (<-subA).Path)
+	require.Len(t, subB, 1)
+	require.Equal(t, "dir/b/yyy", (<-subB).Path)
+
+	unsubA()
+	unsubA()
+	_, ok := <-subA
+	require.False(t, ok)
+
+	fsys["dir/a/zzz"] = &fstest.MapFile{}
+	w.poll()
+	require.Len(t, subB, 0)
+
+	w.Close()
+	_, ok = <-subB
+	require.False(t, ok)
+}
+
+func TestWatcherSuppressDirModify(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithSuppressDirModify(), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	subPath := filepath.Join(dir, "sub")
+	filePath := filepath.Join(dir, "xxx")
+	err = os.Mkdir(subPath, 0755)
+	require.NoError(t, err)
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	w.poll()
+
+	got := make(map[string]Op)
+	for len(w.Events) > 0 {
+		ev := <-w.Events
+		got[ev.Path] = ev.Op
 	}
+	require.Equal(t, map[string]Op{subPath: Create, filePath: Create}, got)
+}
+
+func TestWatcherDirChmod(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	subPath := filepath.Join(dir, "sub")
+	err := os.Mkdir(subPath, 0755)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithSuppressDirModify(), WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+
+	err = os.Chmod(subPath, 0700)
+	require.NoError(t, err)
+	w.poll()
+
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, subPath, ev.Path)
+	require.Equal(t, Chmod, ev.Op)
+	require.True(t, ev.IsDirEvent())
+}
+
+func TestWatcherHistory(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithHistory(3), WithNonBlocking())
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+	require.Empty(t, w.History())
+
+	for i := 0; i < 5; i++ {
+		fsys[fmt.Sprintf("dir/file%d", i)] = &fstest.MapFile{}
+		w.poll()
+	}
+
+	history := w.History()
+	require.Len(t, history, 3)
+	for i, ev := range history {
+		require.Equal(t, fmt.Sprintf("dir/file%d", i+2), ev.Path)
+		require.Equal(t, Create, ev.Op)
+	}
+}
+
+func TestWatcherSortedEvents(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithSortedEvents(), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	for _, name := range []string{"c.txt", "a.txt", "b.txt"} {
+		fsys["dir/"+name] = &fstest.MapFile{}
+	}
+	w.poll()
+
+	require.Len(t, w.Events, 3)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		require.Equal(t, "dir/"+name, (<-w.Events).Path)
+	}
+}
+
+func TestWatcherBatchEvents(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/xxx": {},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithBatchEvents(), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	w.poll()
+	require.Empty(t, w.Batches)
+
+	delete(fsys, "dir/xxx")
+	fsys["dir/yyy"] = &fstest.MapFile{Data: []byte("hello")}
+	fsys["dir/zzz"] = &fstest.MapFile{Data: []byte("world!")}
+	w.poll()
+
+	require.Len(t, w.Batches, 1)
+	batch := <-w.Batches
+	got := make(map[string]Op)
+	for _, ev := range batch {
+		got[ev.Path] = ev.Op
+	}
+	require.Equal(t, map[string]Op{"dir/xxx": Remove, "dir/yyy": Create, "dir/zzz": Create}, got)
+	require.Empty(t, w.Events)
+}
+
+func TestWatcherEventBuffer(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	const n = 3
+	w := NewWatcher(WithFS(fsys), WithEventBuffer(n))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	poll := func() chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			w.poll()
+		}()
+		return done
+	}
+
+	// n events fit without a consumer
+	for i := 0; i < n; i++ {
+		fsys["dir/"+strconv.Itoa(i)] = &fstest.MapFile{}
+	}
+	select {
+	case <-poll():
+	case <-time.After(time.Second):
+		t.Fatal("poll blocked with room in the buffer")
+	}
+	require.Len(t, w.Events, n)
+
+	// one more blocks until the consumer catches up
+	fsys["dir/"+strconv.Itoa(n)] = &fstest.MapFile{}
+	done := poll()
+	select {
+	case <-done:
+		t.Fatal("poll didn't block with a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-w.Events
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("poll still blocked")
+	}
+	require.Len(t, w.Events, n)
+}
+
+func TestWatcherRequireWatches(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithRequireWatches())
+	defer w.Close()
+
+	err := w.Start(10 * time.Millisecond)
+	require.Equal(t, ErrNoWatches, err)
+	require.False(t, w.IsRunning())
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+}
+
+func TestWatcherCloseContext(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	w.OnEvent(func(Event) {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-release // a consumer stuck for good
+	})
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "xxx"), nil, 0644)
+	require.NoError(t, err)
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = w.CloseContext(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, w.IsClosed())
+
+	// cleaned up once the consumer returns
+	close(release)
+	w.Wait()
+	_, ok := <-w.Events
+	require.False(t, ok)
+}
+
+func TestWatcherSnapshot(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"xxx", "yyy"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		require.NoError(t, err)
+	}
+
+	w := NewWatcher()
+	err := w.Add(dir)
+	require.NoError(t, err)
+	data, err := w.Snapshot()
+	require.NoError(t, err)
+	w.Close()
+
+	// changed while no watcher was running
+	filePath := filepath.Join(dir, "zzz")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	w = NewWatcher(WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.RestoreSnapshot([]byte(`{"version":0}`))
+	require.True(t, errors.Is(err, ErrSnapshotVersion))
+	err = w.RestoreSnapshot(data)
+	require.NoError(t, err)
+	require.Equal(t, []string{dir}, w.WatchList())
+
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+	assertEvent(t, w, filePath, Create)
+	assertNoEvent(t, w, 50*time.Millisecond)
+	err = w.RestoreSnapshot(data)
+	require.Equal(t, ErrWatcherStarted, err)
+
+	w.Close()
+	err = w.RestoreSnapshot(data)
+	require.Equal(t, ErrWatcherClosed, err)
+}
+
+func TestWatcherSnapshotAddWith(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/sub/xxx": {Data: []byte("xxx")},
+		"dir/yyy.tmp": {},
+		"dir/zzz":     {Data: []byte("zzz")},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithFingerprintMoves())
+	err := w.AddWith("dir", AddRecursive(1), AddIgnore("dir/*.tmp"))
+	require.NoError(t, err)
+	files := w.Files()
+	data, err := w.Snapshot()
+	require.NoError(t, err)
+	w.Close()
+
+	w = NewWatcher(WithFS(fsys), WithFingerprintMoves(), WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.RestoreSnapshot(data)
+	require.NoError(t, err)
+	require.Equal(t, sortedKeys(files), sortedKeys(w.Files()))
+	require.NotEmpty(t, w.files["dir/zzz"].(*fileInfo).print)
+
+	// listed the way it was added
+	w.poll()
+	require.Empty(t, w.Events)
+	require.Equal(t, sortedKeys(files), sortedKeys(w.Files()))
+}
+
+func TestWatcherReset(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, ErrWatcherStarted, w.Reset())
+
+	w.Close()
+	err = w.Reset()
+	require.NoError(t, err)
+	require.False(t, w.IsClosed())
+	require.Empty(t, w.WatchList())
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, []byte("hello"), 0644)
+	require.NoError(t, err)
+	assertEvent(t, w, filePath, Create)
+}
+
+func TestWatcherStarted(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	select {
+	case <-w.Started():
+		t.Fatal("started before Start")
+	default:
+	}
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+	<-w.Started()
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	assertEvent(t, w, filePath, Create)
+}
+
+func TestWatcherWait(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	// never started
+	w.Wait()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Wait()
+		}()
+	}
+	w.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Wait")
+	}
+	_, ok := <-w.Events
+	require.False(t, ok)
+}
+
+func TestWatcherStartContext(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = w.StartContext(ctx, 10*time.Millisecond)
+	require.NoError(t, err)
+	cancel()
+
+	select {
+	case _, ok := <-w.Events:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the watcher to stop")
+	}
+	_, ok := <-w.Errors
+	require.False(t, ok)
+}
+
+func TestWatcherSlowErrorsConsumer(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+	dir2, _ := os.MkdirTemp("", "test2")
+	defer os.RemoveAll(dir2)
+	dir3, _ := os.MkdirTemp("", "test3")
+	defer os.RemoveAll(dir3)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Add(dir2)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	go func() {
+		for range w.Events {
+		}
+	}()
+
+	// nobody reads Errors while dir2 is missing
+	err = os.RemoveAll(dir2)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		done <- w.Add(dir3)
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Add blocked by a pending error")
+	}
+
+	select {
+	case err := <-w.Errors:
+		require.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+}
+
+func TestWatcherWatchError(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+	go func() {
+		for range w.Events {
+		}
+	}()
+
+	err = os.RemoveAll(dir)
+	require.NoError(t, err)
+
+	select {
+	case err := <-w.Errors:
+		var watchErr *WatchError
+		require.True(t, errors.As(err, &watchErr))
+		require.Equal(t, dir, watchErr.Name)
+		require.True(t, errors.Is(err, fs.ErrNotExist))
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+}
+
+func TestWatcherMissingRetries(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithMissingRetries(2), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err = w.Add(filePath)
+	require.NoError(t, err)
+
+	// missing for a single poll
+	err = os.Remove(filePath)
+	require.NoError(t, err)
+	w.poll()
+	require.Equal(t, []string{filePath}, w.WatchList())
+
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	w.poll()
+	require.Equal(t, []string{filePath}, w.WatchList())
+
+	// missing for two consecutive polls
+	err = os.Remove(filePath)
+	require.NoError(t, err)
+	w.poll()
+	w.poll()
+	require.Empty(t, w.WatchList())
+}
+
+func TestWatcherMissingRetriesKeepsFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/xxx": {},
+		"dir/yyy": {},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithMissingRetries(2), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	// missing for a single poll
+	dir := fstest.MapFS{"dir/xxx": fsys["dir/xxx"], "dir/yyy": fsys["dir/yyy"]}
+	delete(fsys, "dir/xxx")
+	delete(fsys, "dir/yyy")
+	w.poll()
+	<-w.Errors
+	require.Len(t, w.Files(), 3)
+
+	for name, f := range dir {
+		fsys[name] = f
+	}
+	w.poll()
+	require.Empty(t, w.Events)
+	require.Len(t, w.Files(), 3)
+}
+
+func TestWatcherPause(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	w.Pause()
+	for _, name := range []string{"xxx", "yyy", "zzz"} {
+		err = os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		require.NoError(t, err)
+	}
+	w.poll()
+	w.Resume()
+	w.poll()
+	require.Empty(t, w.Events)
+
+	filePath := filepath.Join(dir, "aaa")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	w.poll()
+	assertEvent(t, w, filePath, Create)
+}
+
+func TestWatcherPauseHeld(t *testing.T) {
+	modTime := time.Now()
+	fsys := fstest.MapFS{
+		"dir/xxx": {Data: []byte("x"), ModTime: modTime},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithStableModTime(2), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/xxx"] = &fstest.MapFile{Data: []byte("xx"), ModTime: modTime.Add(time.Second)}
+	w.poll()
+	require.Empty(t, w.Events)
+
+	w.Pause()
+	w.poll()
+	w.Resume()
+	for i := 0; i < 3; i++ {
+		w.poll()
+	}
+	require.Empty(t, w.Events)
+}
+
+func TestWatcherDrainOnClose(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithDrainOnClose())
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(time.Hour)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	w.Close()
+
+	var found bool
+	for _, ev := range w.Pending() {
+		if ev.Path == filePath {
+			require.True(t, ev.HasOps(Create))
+			found = true
+		}
+	}
+	require.True(t, found)
+}
+
+func TestWatcherDrainOnCloseBlocked(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+	clock := newFakeClock()
+
+	w := NewWatcher(WithFS(fsys), WithClock(clock), WithDrainOnClose())
+	err := w.Add("dir")
+	require.NoError(t, err)
+	err = w.Start(time.Hour)
+	require.NoError(t, err)
+
+	for _, name := range []string{"dir/xxx", "dir/yyy", "dir/zzz"} {
+		fsys[name] = &fstest.MapFile{}
+	}
+	clock.tick()
+	time.Sleep(50 * time.Millisecond) // blocked sending the first event
+	w.Close()
+
+	var paths []string
+	for _, ev := range w.Pending() {
+		require.Equal(t, Create, ev.Op)
+		paths = append(paths, ev.Path)
+	}
+	require.Equal(t, []string{"dir/xxx", "dir/yyy", "dir/zzz"}, paths)
+}
+
+func TestWatcherNonBlocking(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithNonBlocking(), WithEventBuffer(1), WithErrorBuffer(1))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	for _, name := range []string{"xxx", "yyy", "zzz"} {
+		err = os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		require.NoError(t, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.poll()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("poll blocked on a full channel")
+	}
+
+	require.Len(t, w.Events, 1)
+	require.True(t, w.Dropped() >= 2)
+
+	err = <-w.Errors
+	var overflowErr *OverflowError
+	require.True(t, errors.As(err, &overflowErr))
+	require.Equal(t, w.Dropped(), overflowErr.Dropped)
+}
+
+func TestWatcherFS(t *testing.T) {
+	modTime := time.Now()
+	fsys := fstest.MapFS{
+		"dir/xxx": {Data: []byte("xxx"), ModTime: modTime},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+	require.Contains(t, w.Files(), "dir/xxx")
+
+	fsys["dir/yyy"] = &fstest.MapFile{ModTime: modTime}
+	w.poll()
+	assertEvent(t, w, "dir/yyy", Create)
+
+	// MapFS file infos read through to their MapFile, so replace it
+	fsys["dir/xxx"] = &fstest.MapFile{Data: []byte("xxx"), ModTime: modTime.Add(time.Second)}
+	w.poll()
+	assertEvent(t, w, "dir/xxx", Modify)
+
+	delete(fsys, "dir/yyy")
+	w.poll()
+	assertEvent(t, w, "dir/yyy", Remove)
+}
+
+func TestWatcherIgnoreModTime(t *testing.T) {
+	modTime := time.Now()
+	fsys := fstest.MapFS{
+		"dir/xxx": {Data: []byte("xxx"), ModTime: modTime},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithIgnoreModTime(), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	// touched
+	fsys["dir/xxx"] = &fstest.MapFile{Data: []byte("xxx"), ModTime: modTime.Add(time.Second)}
+	w.poll()
+	require.Empty(t, w.Events)
+
+	fsys["dir/xxx"] = &fstest.MapFile{Data: []byte("xxxx"), ModTime: modTime.Add(time.Second)}
+	w.poll()
+	assertEvent(t, w, "dir/xxx", Modify)
+}
+
+func TestWatcherComparator(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/xxx": {Data: []byte("xxx")},
+	}
+
+	grown := func(old, curr os.FileInfo) Op {
+		if curr.Size() > old.Size() {
+			return Modify
+		}
+		return 0
+	}
+	w := NewWatcher(WithFS(fsys), WithComparator(grown), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/xxx"] = &fstest.MapFile{Data: []byte("x"), Mode: 0600}
+	w.poll()
+	require.Empty(t, w.Events)
+
+	fsys["dir/xxx"] = &fstest.MapFile{Data: []byte("xxxx")}
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "dir/xxx", ev.Path)
+	require.Equal(t, Modify, ev.Op)
+}
+
+func TestWatcherClock(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+	w := NewWatcher(WithClock(clock))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(time.Hour)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	go clock.tick()
+	assertEvent(t, w, filePath, Create)
+
+	err = os.Remove(filePath)
+	require.NoError(t, err)
+	go w.PollNow()
+	assertEvent(t, w, filePath, Remove)
+}
+
+func TestWatcherSlowPoll(t *testing.T) {
+	fsys := &slowFS{
+		MapFS: fstest.MapFS{
+			"dir/xxx": {},
+		},
+		slow: "dir",
+	}
+	fsys.delay.Store(20 * time.Millisecond)
+	clock := newFakeClock()
+	logger := &captureLogger{}
+
+	w := NewWatcher(WithFS(fsys), WithClock(clock), WithLogger(logger))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+	err = w.Start(time.Millisecond)
+	require.NoError(t, err)
+
+	// the third tick is read once the second poll is over
+	for i := 0; i < 3; i++ {
+		clock.tick()
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	require.Len(t, logger.lines, 1)
+	require.Contains(t, logger.lines[0], "longer than the 1ms interval")
+}
+
+func TestWatcherHealthy(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+	w := NewWatcher(WithClock(clock))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(time.Hour)
+	require.NoError(t, err)
+	require.False(t, w.Healthy(time.Hour))
+
+	// the second tick returns once the first poll is done
+	clock.tick()
+	clock.tick()
+	require.False(t, w.LastPollTime().IsZero())
+	require.True(t, w.Healthy(50*time.Millisecond))
+
+	// no polls meanwhile
+	time.Sleep(60 * time.Millisecond)
+	require.False(t, w.Healthy(50*time.Millisecond))
+
+	w.Close()
+	require.False(t, w.Healthy(time.Hour))
+}
+
+func TestWatcherPollJitter(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	clock := newFakeClock()
+	w := NewWatcher(WithClock(clock), WithPollJitter(0.2))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(100 * time.Millisecond)
+	require.NoError(t, err)
+
+	// the last tick returns once the previous poll reset the ticker
+	for i := 0; i < 11; i++ {
+		clock.tick()
+	}
+
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	require.True(t, len(clock.intervals) >= 11)
+	seen := make(map[time.Duration]struct{})
+	for _, d := range clock.intervals {
+		require.True(t, d >= 80*time.Millisecond && d <= 120*time.Millisecond, d)
+		seen[d] = struct{}{}
+	}
+	require.True(t, len(seen) > 1)
+}
+
+func TestWatcherErrorBackoff(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	clock := newFakeClock()
+	w := NewWatcher(WithFS(fsys), WithClock(clock), WithErrorBackoff(80*time.Millisecond),
+		WithMissingRetries(10), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	dir := fsys["dir"]
+	delete(fsys, "dir")
+	for i := 0; i < 4; i++ {
+		clock.tick()
+		<-w.Errors
+	}
+	fsys["dir"] = dir
+	// the last tick returns once the previous poll reset the ticker
+	clock.tick()
+	clock.tick()
+
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	ms := time.Millisecond
+	require.Equal(t, []time.Duration{10 * ms, 20 * ms, 40 * ms, 80 * ms, 80 * ms, 10 * ms}, clock.intervals[:6])
+}
+
+func TestWaitFor(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	err = WaitFor(w, filePath, Create, time.Second)
+	require.NoError(t, err)
+
+	err = WaitFor(w, filePath, Remove, 50*time.Millisecond)
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	w.Close()
+	err = WaitFor(w, filePath, Remove, time.Second)
+	require.Equal(t, ErrWatcherClosed, err)
+}
+
+func TestWatcherRange(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/xxx"] = &fstest.MapFile{}
+	fsys["dir/yyy"] = &fstest.MapFile{}
+	w.poll()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var events []Event
+	err = w.Range(ctx, func(ev Event) error {
+		events = append(events, ev)
+		cancel()
+		return nil
+	})
+	require.Equal(t, context.Canceled, err)
+	require.Len(t, events, 1)
+	require.Len(t, w.Events, 1)
+
+	errStop := errors.New("stop")
+	err = w.Range(context.Background(), func(ev Event) error {
+		return errStop
+	})
+	require.Equal(t, errStop, err)
+
+	w.Close()
+	err = w.Range(context.Background(), func(ev Event) error {
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestWatchOnce(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.WriteFile(filePath, nil, 0644)
+	}()
+
+	w := NewWatcher()
+	ev, err := watchOnce(w, dir, Create, 10*time.Millisecond, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, filePath, ev.Path)
+	require.True(t, w.IsClosed())
+
+	_, err = WatchOnce(dir, Remove, 10*time.Millisecond, 50*time.Millisecond)
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
+
+func TestWatcherPollNow(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithEventBuffer(100))
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(time.Millisecond)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := w.PollNow(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	assertEvent(t, w, filePath, Create)
+
+	// the file was reported exactly once
+	w.Close()
+	for ev := range w.Events {
+		require.NotEqual(t, filePath, ev.Path)
+	}
+	require.Equal(t, ErrWatcherClosed, w.PollNow())
+}
+
+func TestWatcherPollNowClose(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		fsys := &slowOpenFS{
+			MapFS: fstest.MapFS{
+				"dir/xxx": {Data: []byte("x")},
+			},
+		}
+		w := NewWatcher(WithFS(fsys), WithContentHash(), WithAppendDetection(), WithNonBlocking())
+		err := w.Add("dir")
+		require.NoError(t, err)
+
+		// hashed while listing, then while comparing
+		fsys.MapFS["dir/xxx"] = &fstest.MapFile{Data: []byte("xx")}
+		fsys.delay.Store(20 * time.Millisecond)
+		errc := make(chan error)
+		go func() {
+			errc <- w.PollNow()
+		}()
+		time.Sleep(30 * time.Millisecond)
+		w.Close() // while PollNow compares
+
+		err = <-errc
+		require.True(t, err == nil || err == ErrWatcherClosed)
+		for range w.Events {
+		}
+	}
+}
+
+func TestWatcherRemoveRoot(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	err = os.RemoveAll(dir)
+	require.NoError(t, err)
+	w.poll()
+	require.Empty(t, w.WatchList())
+
+	for len(w.Events) > 0 {
+		ev := <-w.Events
+		if ev.Path == dir {
+			require.Equal(t, Remove, ev.Op)
+			require.True(t, ev.IsDirEvent())
+			return
+		}
+	}
+	t.Fatal("no Remove event for the root")
+}
+
+func TestWatcherRemoveRootEntries(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	expected := map[string]Op{dir: Remove}
+	for _, name := range []string{"xxx", "yyy", "zzz"} {
+		fp := filepath.Join(dir, name)
+		err := os.WriteFile(fp, nil, 0644)
+		require.NoError(t, err)
+		expected[fp] = Remove
+	}
+
+	w := NewWatcher(WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	err = os.RemoveAll(dir)
+	require.NoError(t, err)
+	w.poll()
+
+	got := make(map[string]Op)
+	for len(w.Events) > 0 {
+		ev := <-w.Events
+		got[ev.Path] = ev.Op
+	}
+	require.Equal(t, expected, got)
+	require.Len(t, w.Errors, 1)
+}
+
+func TestWatcherAutoReAdd(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithAutoReAdd(), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	err = os.RemoveAll(dir)
+	require.NoError(t, err)
+	w.poll()
+	w.poll()
+	require.Equal(t, []string{dir}, w.WatchList())
+	require.Len(t, w.Errors, 1)
+	<-w.Errors
+	for len(w.Events) > 0 {
+		<-w.Events
+	}
+
+	err = os.Mkdir(dir, 0755)
+	require.NoError(t, err)
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	w.poll()
+	assertEvent(t, w, filePath, Create)
+}
+
+func TestWatcherErrorDedup(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithErrorDedup(time.Hour), WithMissingRetries(10), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	err = os.RemoveAll(dir)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		w.poll()
+	}
+	require.Len(t, w.Errors, 1)
+}
+
+func TestWatcherEventTime(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	// the detection time, not the file's ModTime
+	past := time.Now().Add(-time.Hour)
+	err = os.Chtimes(filePath, past, past)
+	require.NoError(t, err)
+	w.poll()
+
+	ev := nextEvent(t, w)
+	require.Equal(t, filePath, ev.Path)
+	require.WithinDuration(t, time.Now(), ev.Time, time.Second)
+}
+
+func TestWatcherEventSeq(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithEventBuffer(100))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	for _, name := range []string{"xxx", "yyy", "zzz"} {
+		err = os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		require.NoError(t, err)
+		w.poll()
+	}
+
+	var last uint64
+	for len(w.Events) > 0 {
+		ev := <-w.Events
+		require.True(t, ev.Seq > last)
+		last = ev.Seq
+	}
+	require.True(t, last >= 3)
+}
+
+func TestWatcherAddDuringScan(t *testing.T) {
+	fsys := slowFS{
+		MapFS: fstest.MapFS{
+			"slow/xxx": {},
+			"fast/xxx": {},
+		},
+		slow: "slow",
+	}
+
+	w := NewWatcher(WithFS(&fsys), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("slow")
+	require.NoError(t, err)
+
+	fsys.delay.Store(500 * time.Millisecond)
+	go w.poll()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	err = w.Add("fast")
+	require.NoError(t, err)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestWatcherMaxDepth(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	level1 := filepath.Join(dir, "l1")
+	level2 := filepath.Join(level1, "l2")
+	err := os.MkdirAll(level2, 0755)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithMaxDepth(1), WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+	require.Contains(t, w.Files(), level2)
+
+	err = os.WriteFile(filepath.Join(level2, "xxx"), nil, 0644)
+	require.NoError(t, err)
+	w.poll()
+	for len(w.Events) > 0 {
+		ev := <-w.Events
+		require.True(t, ev.IsDirEvent(), "unexpected event %s", ev.String())
+	}
+
+	filePath := filepath.Join(level1, "yyy")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	w.poll()
+	assertEvent(t, w, filePath, Create)
+}
+
+func TestWatcherSymlinks(t *testing.T) {
+	for _, follow := range []bool{true, false} {
+		t.Run(fmt.Sprintf("follow=%v", follow), func(t *testing.T) {
+			dir, _ := os.MkdirTemp("", "test")
+			defer os.RemoveAll(dir)
+			targetDir, _ := os.MkdirTemp("", "target")
+			defer os.RemoveAll(targetDir)
+
+			target := filepath.Join(targetDir, "xxx")
+			err := os.WriteFile(target, nil, 0644)
+			require.NoError(t, err)
+			link := filepath.Join(dir, "link")
+			err = os.Symlink(target, link)
+			require.NoError(t, err)
+			// a loop back to the watched directory
+			err = os.Symlink(dir, filepath.Join(dir, "loop"))
+			require.NoError(t, err)
+
+			w := NewWatcher(WithFollowSymlinks(follow), WithMaxDepth(10), WithEventBuffer(10))
+			defer w.Close()
+
+			err = w.Add(dir)
+			require.NoError(t, err)
+			require.Equal(t, !follow, w.Files()[link].Mode()&os.ModeSymlink != 0)
+
+			writeFile(t, target, []byte("modified"), os.O_APPEND)
+			w.poll()
+			if follow {
+				assertEvent(t, w, link, Modify)
+			} else {
+				require.Empty(t, w.Events)
+			}
+		})
+	}
+}
+
+func TestWatcherStats(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithEventBuffer(100))
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	filePath := filepath.Join(dir, "xxx")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "yyy"), nil, 0644)
+	require.NoError(t, err)
+	w.poll()
+	err = os.Remove(filePath)
+	require.NoError(t, err)
+	w.poll()
+
+	stats := w.Stats()
+	require.Equal(t, uint64(2), stats.Polls)
+	require.Equal(t, uint64(2), stats.Events[Create])
+	require.Equal(t, uint64(1), stats.Events[Remove])
+	require.Equal(t, uint64(0), stats.Errors)
+	require.Equal(t, 2, stats.Files)
+	require.True(t, stats.LastPollDuration > 0)
+}
+
+func TestWatcherLogger(t *testing.T) {
+	fsys := brokenInfoFS{
+		MapFS: fstest.MapFS{
+			"dir/xxx": {},
+			"dir/yyy": {},
+		},
+		broken: "xxx",
+	}
+	logger := &captureLogger{}
+
+	w := NewWatcher(WithFS(fsys), WithLogger(logger))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+	require.Len(t, logger.lines, 1)
+	require.Contains(t, logger.lines[0], "dir/xxx")
+}
+
+func TestWatcherName(t *testing.T) {
+	fsys := brokenInfoFS{
+		MapFS: fstest.MapFS{
+			"dir/xxx": {},
+		},
+		broken: "xxx",
+	}
+	logger := &captureLogger{}
+
+	w := NewWatcher(WithFS(fsys), WithName("ingest"), WithLogger(logger), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+	require.Len(t, logger.lines, 1)
+	require.True(t, strings.HasPrefix(logger.lines[0], "ingest: "))
+
+	delete(fsys.MapFS, "dir/xxx")
+	w.poll()
+	w.poll()
+	require.NotEmpty(t, w.Errors)
+	err = <-w.Errors
+	var watchErr *WatchError
+	require.True(t, errors.As(err, &watchErr))
+	require.Equal(t, "ingest", watchErr.Watcher)
+	require.Contains(t, err.Error(), "ingest")
+}
+
+func TestWatcherEntryInfoError(t *testing.T) {
+	fsys := brokenInfoFS{
+		MapFS: fstest.MapFS{
+			"dir/yyy": {},
+		},
+		broken: "xxx",
+	}
+
+	w := NewWatcher(WithFS(brokenStatFS{fsys}), WithErrorBuffer(1), WithEventBuffer(1))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	// neither Info nor Stat works for the new entry, it's left out and reported
+	fsys.MapFS["dir/xxx"] = &fstest.MapFile{}
+	require.NotPanics(t, w.poll)
+
+	var werr *WatchError
+	require.True(t, errors.As(<-w.Errors, &werr))
+	require.Equal(t, "dir", werr.Name)
+	require.Contains(t, werr.Error(), "dir/xxx")
+	require.NotContains(t, w.Files(), "dir/xxx")
+	require.Empty(t, w.Events)
+}
+
+func TestWatcherMaxFiles(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for i := 0; i < 10; i++ {
+		fsys["dir/"+strconv.Itoa(i)] = &fstest.MapFile{}
+	}
+
+	w := NewWatcher(WithFS(fsys), WithMaxFiles(3), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+	require.Len(t, w.Files(), 3)
+
+	w.poll()
+	require.Len(t, w.Errors, 1)
+	require.True(t, errors.Is(<-w.Errors, ErrTooManyFiles))
+	require.Empty(t, w.Events)
+	require.Equal(t, []string{"dir", "dir/0", "dir/1"}, sortedKeys(w.Files()))
+}
+
+func TestWatcherReadRetriesChunks(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"xxx", "yyy"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	fsys := &chunkFailFS{fileSystem: osFS{}}
+	w := NewWatcher(WithReadRetries(2, time.Millisecond), WithSuppressDirModify(), WithEventBuffer(10), WithErrorBuffer(10))
+	w.fs = fsys
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	fsys.fails.Store(2)
+	filePath := filepath.Join(dir, "zzz")
+	require.NoError(t, os.WriteFile(filePath, nil, 0644))
+	w.poll()
+	require.Empty(t, w.Errors)
+	assertEvent(t, w, filePath, Create)
+	assertNoEvent(t, w, 50*time.Millisecond)
+
+	// giving up after n retries
+	fsys.fails.Store(3)
+	w.poll()
+	require.Len(t, w.Errors, 1)
+}
+
+func TestWatcherReadRetriesEntryErrors(t *testing.T) {
+	fsys := brokenInfoFS{
+		MapFS: fstest.MapFS{
+			"dir/yyy": {},
+		},
+		broken: "xxx",
+	}
+	chunks := &chunkFailFS{fileSystem: ioFS{brokenStatFS{fsys}}}
+
+	w := NewWatcher(WithReadRetries(1, time.Millisecond), WithEventBuffer(10), WithErrorBuffer(10))
+	w.fs = chunks
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	// the entry left out is reported once, not once per read
+	fsys.MapFS["dir/xxx"] = &fstest.MapFile{}
+	chunks.fails.Store(1)
+	w.poll()
+	require.Len(t, w.Errors, 1)
+	require.Empty(t, w.Events)
+}
+
+func TestWatcherReadRetries(t *testing.T) {
+	fsys := &flakyFS{MapFS: fstest.MapFS{
+		"dir/xxx": {},
+	}}
+
+	w := NewWatcher(WithFS(fsys), WithReadRetries(2, time.Millisecond), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys.fails.Store(2)
+	fsys.MapFS["dir/yyy"] = &fstest.MapFile{}
+	w.poll()
+	require.Empty(t, w.Errors)
+	assertEvent(t, w, "dir/yyy", Create)
+
+	// giving up after n retries
+	fsys.fails.Store(3)
+	w.poll()
+	require.Len(t, w.Errors, 1)
+}
+
+func TestWatcherGlob(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, "a.log"))
+	require.NoError(t, err)
+	f.Close()
+
+	w := NewWatcher()
+	defer w.Close()
+
+	// a pattern without matches is not an error
+	err = w.Add(filepath.Join(dir, "*.txt"))
+	require.NoError(t, err)
+	err = w.Add(filepath.Join(dir, "*.log"))
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	newFilePath := filepath.Join(dir, "b.log")
+	f, err = os.Create(newFilePath)
+	require.NoError(t, err)
+	f.Close()
+	assertEvent(t, w, newFilePath, Create)
+}
+
+func TestWatcherRelativeName(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(wd)
+	err = os.Chdir(dir)
+	require.NoError(t, err)
+	dir, err = os.Getwd()
+	require.NoError(t, err)
+
+	w := NewWatcher(WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.Add(".")
+	require.NoError(t, err)
+	require.Equal(t, []string{dir}, w.WatchList())
+	events, unsubscribe := w.Subscribe("xxx")
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = os.WriteFile("xxx", nil, 0644)
+	require.NoError(t, err)
+	select {
+	case ev := <-events:
+		require.Equal(t, filepath.Join(dir, "xxx"), ev.Path)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for subscribed event")
+	}
+	assertEvent(t, w, filepath.Join(dir, "xxx"), Create)
+	unsubscribe()
+
+	err = os.Remove("xxx")
+	require.NoError(t, err)
+	err = WaitFor(w, "xxx", Remove, time.Second)
+	require.NoError(t, err)
+
+	err = w.Remove(".")
+	require.NoError(t, err)
+	require.Empty(t, w.WatchList())
+}
+
+func TestWatcherAddWith(t *testing.T) {
+	fsys := fstest.MapFS{
+		"deep/a/b/xxx":    {},
+		"deep/a/b/x.log":  {},
+		"flat/a/b/yyy":    {},
+		"flat/a/b/y.log":  {},
+		"flat/a/zzz":      {},
+		"flat/a/z.tmp":    {},
+		"flat/www":        {},
+		"flat/w.tmp":      {},
+		"deep/a/b/c/vvvv": {},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.AddWith("deep", AddRecursive(2), AddIgnore("*.log"))
+	require.NoError(t, err)
+	err = w.AddWith("flat", AddIgnore("*.tmp"), AddFilter(func(ev Event) bool {
+		return ev.Op != Remove
+	}))
+	require.NoError(t, err)
+
+	expected := []string{
+		"deep", "deep/a", "deep/a/b", "deep/a/b/c", "deep/a/b/xxx",
+		"flat", "flat/a", "flat/www",
+	}
+	require.Equal(t, expected, sortedKeys(w.Files()))
+
+	// the filter only applies to flat
+	delete(fsys, "flat/www")
+	delete(fsys, "deep/a/b/xxx")
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "deep/a/b/xxx", ev.Path)
+	require.Equal(t, Remove, ev.Op)
+}
+
+func TestWatcherAddFilterGlob(t *testing.T) {
+	fsys := fstest.MapFS{
+		"logs/a.log": {},
+		"logs/b.txt": {},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err := w.AddWith("logs/*.log", AddFilter(func(ev Event) bool {
+		return ev.Op != Remove
+	}))
+	require.NoError(t, err)
+	err = w.Add("logs/b.txt")
+	require.NoError(t, err)
+
+	delete(fsys, "logs/a.log")
+	delete(fsys, "logs/b.txt")
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "logs/b.txt", ev.Path)
+	require.Equal(t, Remove, ev.Op)
+}
+
+func TestWatcherRemoveGlob(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "a.log")
+	txtPath := filepath.Join(dir, "a.txt")
+	for _, fp := range []string{logPath, txtPath} {
+		err := os.WriteFile(fp, nil, 0644)
+		require.NoError(t, err)
+	}
+
+	w := NewWatcher()
+	defer w.Close()
+
+	pattern := filepath.Join(dir, "*.log")
+	err := w.AddAll(pattern, filepath.Join(dir, "*.txt"))
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = w.Remove(pattern)
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "*.txt")}, w.WatchList())
+	require.Len(t, w.Files(), 1)
+	require.Contains(t, w.Files(), txtPath)
+
+	writeFile(t, logPath, []byte("hello"), os.O_APPEND)
+	err = os.WriteFile(filepath.Join(dir, "b.log"), nil, 0644)
+	require.NoError(t, err)
+	assertNoEvent(t, w, 100*time.Millisecond)
+}
+
+func TestWatcherAlreadyWatching(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+	dir2, _ := os.MkdirTemp("", "test2")
+	defer os.RemoveAll(dir2)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Add(dir)
+	require.True(t, errors.Is(err, ErrAlreadyWatching))
+
+	// none are added
+	err = w.AddAll(dir2, dir2)
+	require.True(t, errors.Is(err, ErrAlreadyWatching))
+	require.Equal(t, []string{dir}, w.WatchList())
+
+	// fine once removed
+	err = w.Remove(dir)
+	require.NoError(t, err)
+	err = w.Add(dir)
+	require.NoError(t, err)
+}
+
+func TestWatcherWatchList(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+	dir2, _ := os.MkdirTemp("", "test2")
+	defer os.RemoveAll(dir2)
+
+	w := NewWatcher()
+	require.Empty(t, w.WatchList())
+
+	err := w.Add(dir2)
+	require.NoError(t, err)
+	err = w.Add(dir)
+	require.NoError(t, err)
+
+	expected := []string{dir, dir2}
+	sort.Strings(expected)
+	require.Equal(t, expected, w.WatchList())
+
+	w.Close()
+	require.Empty(t, w.WatchList())
+}
+
+func TestWatcherAddAsync(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 20; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("sub%d", i))
+		require.NoError(t, os.Mkdir(sub, 0755))
+		for j := 0; j < 50; j++ {
+			require.NoError(t, os.WriteFile(filepath.Join(sub, fmt.Sprintf("file%d", j)), []byte("hello"), 0644))
+		}
+	}
+
+	w := NewWatcher(WithMaxDepth(1))
+	defer w.Close()
+
+	errc := w.AddAsync(dir)
+	select {
+	case err := <-errc:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for AddAsync")
+	}
+	_, ok := <-errc
+	require.False(t, ok)
+
+	require.Equal(t, []string{dir}, w.WatchList())
+	require.Len(t, w.Files(), 1+20+20*50)
+
+	err := <-w.AddAsync(dir)
+	require.True(t, errors.Is(err, ErrAlreadyWatching))
+}
+
+func TestWatcherAddAll(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+	dir2, _ := os.MkdirTemp("", "test2")
+	defer os.RemoveAll(dir2)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err := w.AddAll()
+	require.NoError(t, err)
+
+	err = w.AddAll(dir, filepath.Join(dir, "missing"), dir2)
+	require.Error(t, err)
+	require.Empty(t, w.WatchList())
+	require.Empty(t, w.Files())
+
+	err = w.AddAll(dir, dir2)
+	require.NoError(t, err)
+	require.Len(t, w.WatchList(), 2)
+}
+
+func TestWatcherRemoveNested(t *testing.T) {
+	root, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, "foo")
+	sibling := filepath.Join(root, "foobar")
+	nested := filepath.Join(dir, "a", "b")
+	require.NoError(t, os.MkdirAll(nested, 0755))
+	require.NoError(t, os.Mkdir(sibling, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(nested, "xxx"), nil, 0644))
+
+	w := NewWatcher(WithMaxDepth(2))
+	defer w.Close()
+
+	err := w.AddAll(dir, nested, sibling)
+	require.NoError(t, err)
+
+	// nested was added on its own, so it's still watched
+	err = w.Remove(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{nested, sibling}, w.WatchList())
+	require.Len(t, w.Files(), 3)
+	require.Contains(t, w.Files(), sibling)
+	require.Contains(t, w.Files(), nested)
+	require.Contains(t, w.Files(), filepath.Join(nested, "xxx"))
+}
+
+func TestWatcherRemoveOverlapping(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	sub := filepath.Join(dir, "sub")
+	require.NoError(t, os.Mkdir(sub, 0755))
+
+	w := NewWatcher(WithMaxDepth(1), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.AddAll(dir, sub)
+	require.NoError(t, err)
+
+	err = w.Remove(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{sub}, w.WatchList())
+
+	filePath := filepath.Join(sub, "xxx")
+	require.NoError(t, os.WriteFile(filePath, nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "yyy"), nil, 0644))
+	w.poll()
+
+	assertEvent(t, w, filePath, Create)
+	assertNoEvent(t, w, 50*time.Millisecond)
+}
+
+func TestWatcherRemoveHeld(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir":  {Mode: fs.ModeDir},
+		"dir2": {Mode: fs.ModeDir},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithAggregateWindow(50*time.Millisecond), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.AddAll("dir", "dir2")
+	require.NoError(t, err)
+
+	fsys["dir/xxx"] = &fstest.MapFile{}
+	fsys["dir2/yyy"] = &fstest.MapFile{}
+	w.poll()
+	err = w.Remove("dir")
+	require.NoError(t, err)
+
+	time.Sleep(60 * time.Millisecond)
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, "dir2/yyy", ev.Path)
+
+	fsys["dir2/zzz"] = &fstest.MapFile{}
+	w.poll()
+	err = w.RemoveAll()
+	require.NoError(t, err)
+
+	time.Sleep(60 * time.Millisecond)
+	w.poll()
+	require.Empty(t, w.Events)
+}
+
+func TestWatcherRemoveAll(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+	dir2, _ := os.MkdirTemp("", "test2")
+	defer os.RemoveAll(dir2)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Add(dir2)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = w.RemoveAll()
+	require.NoError(t, err)
+	require.Empty(t, w.WatchList())
+	require.Empty(t, w.Files())
+
+	err = os.WriteFile(filepath.Join(dir, "xxx"), nil, 0644)
+	require.NoError(t, err)
+	assertNoEvent(t, w, 100*time.Millisecond)
+
+	// still running and accepting new names
+	require.True(t, w.IsRunning())
+	err = w.Add(dir2)
+	require.NoError(t, err)
+}
+
+func TestWatcherFiles(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	expected := []string{dir}
+	for _, name := range []string{"xxx", "yyy"} {
+		fp := filepath.Join(dir, name)
+		err := os.WriteFile(fp, nil, 0644)
+		require.NoError(t, err)
+		expected = append(expected, fp)
+	}
+
+	w := NewWatcher()
+	defer w.Close()
+	err := w.Add(dir)
+	require.NoError(t, err)
+
+	files := w.Files()
+	require.Len(t, files, len(expected))
+	for _, fp := range expected {
+		require.Contains(t, files, fp)
+	}
+
+	// mutating the copy leaves the watcher alone
+	delete(files, dir)
+	require.Contains(t, w.Files(), dir)
+}
+
+func TestNewWatcherOptions(t *testing.T) {
+	w := NewWatcher()
+	require.Equal(t, 0, cap(w.Events))
+	require.Equal(t, 0, cap(w.Errors))
+	require.Equal(t, 0, w.maxDepth)
+
+	w = NewWatcher(WithEventBuffer(10))
+	require.Equal(t, 10, cap(w.Events))
+	require.Equal(t, 0, cap(w.Errors))
+
+	w = NewWatcher(WithErrorBuffer(5))
+	require.Equal(t, 0, cap(w.Events))
+	require.Equal(t, 5, cap(w.Errors))
+
+	w = NewWatcher(WithMaxDepth(2))
+	require.Equal(t, 2, w.maxDepth)
+}
+
+func TestWatcherContentHash(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, []byte("aaa"), 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithContentHash())
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	// same size, different content
+	writeFile(t, filePath, []byte("bbb"), 0)
+	assertEvent(t, w, filePath, Modify)
+
+	// touch only
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(filePath, later, later)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	otherFilePath := filepath.Join(dir, "yyy")
+	err = os.WriteFile(otherFilePath, nil, 0644)
+	require.NoError(t, err)
+	assertEvent(t, w, otherFilePath, Create)
+}
+
+func TestWatcherInitialScan(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	expected := map[string]struct{}{}
+	for _, name := range []string{"xxx", "yyy"} {
+		fp := filepath.Join(dir, name)
+		err := os.WriteFile(fp, nil, 0644)
+		require.NoError(t, err)
+		expected[fp] = struct{}{}
+	}
+
+	w := NewWatcher(WithInitialScan())
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	got := map[string]struct{}{}
+	for len(got) < len(expected) {
+		ev := nextEvent(t, w)
+		require.True(t, ev.HasOps(Create))
+		got[ev.Path] = struct{}{}
+	}
+	require.Equal(t, expected, got)
+}
+
+func TestWatcherTruncate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, []byte("hello"), 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = os.Truncate(filePath, 0)
+	require.NoError(t, err)
+	assertEvent(t, w, filePath, Truncate)
+	require.Equal(t, "TRUNCATE", Truncate.String())
+}
+
+func TestWatcherAppend(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, []byte("hello"), 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithAppendDetection(), WithContentHash(), WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+
+	writeFile(t, filePath, []byte(" world"), os.O_APPEND)
+	w.poll()
+	ev := nextEvent(t, w)
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Append, ev.Op)
+	require.Equal(t, "APPEND", Append.String())
+
+	// growing while rewriting what was there is a modify
+	writeFile(t, filePath, []byte("HELLO world!"), 0)
+	w.poll()
+	ev = nextEvent(t, w)
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Modify, ev.Op)
+}
+
+func TestWatcherChown(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ownership is checked on linux")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership needs root")
+	}
+
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithOwnershipTracking(), WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+
+	err = os.Chown(filePath, 1, 1)
+	require.NoError(t, err)
+	w.poll()
+	ev := nextEvent(t, w)
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Chown, ev.Op)
+	require.Equal(t, "CHOWN", Chown.String())
+}
+
+func TestWatcherCaseInsensitive(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dir/Foo": {Data: []byte("hello")},
+	}
+
+	w := NewWatcher(WithFS(fsys), WithCaseInsensitive(), WithEventBuffer(10))
+	defer w.Close()
+
+	err := w.Add("dir")
+	require.NoError(t, err)
+
+	fsys["dir/foo"] = fsys["dir/Foo"]
+	delete(fsys, "dir/Foo")
+	w.poll()
+
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, Rename, ev.Op)
+	require.Equal(t, "dir/Foo", ev.Path)
+	require.Equal(t, "dir/foo", ev.NewPath)
+}
+
+func TestWatcherWatchParentForFiles(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, []byte("hello"), 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithWatchParentForFiles(), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err = w.Add(filePath)
+	require.NoError(t, err)
+
+	// written to a temp file, renamed over the original
+	tmpPath := filepath.Join(dir, "xxx.tmp")
+	err = os.WriteFile(tmpPath, []byte("hello world"), 0644)
+	require.NoError(t, err)
+	err = os.Rename(tmpPath, filePath)
+	require.NoError(t, err)
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Modify, ev.Op)
+
+	// moved away, polled, then written anew
+	err = os.Rename(filePath, filePath+"~")
+	require.NoError(t, err)
+	w.poll()
+	require.Empty(t, w.Events)
+	require.Empty(t, w.Errors)
+	err = os.WriteFile(filePath, []byte("hello again"), 0644)
+	require.NoError(t, err)
+	w.poll()
+	require.Len(t, w.Events, 1)
+	ev = <-w.Events
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Modify, ev.Op)
+	require.Equal(t, []string{filePath}, w.WatchList())
+}
+
+func TestWatcherSymlinkedName(t *testing.T) {
+	targetDir, _ := os.MkdirTemp("", "target")
+	defer os.RemoveAll(targetDir)
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	link := filepath.Join(dir, "link")
+	err := os.Symlink(targetDir, link)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.Add(link)
+	require.NoError(t, err)
+	require.True(t, w.Files()[link].IsDir())
+
+	err = os.WriteFile(filepath.Join(targetDir, "xxx"), nil, 0644)
+	require.NoError(t, err)
+	w.poll()
+	assertEvent(t, w, filepath.Join(link, "xxx"), Create)
+}
+
+func TestWatcherSymlinkTarget(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"xxx", "yyy"} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		require.NoError(t, err)
+	}
+	linkPath := filepath.Join(dir, "link")
+	err := os.Symlink(filepath.Join(dir, "xxx"), linkPath)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.Add(linkPath)
+	require.NoError(t, err)
+
+	err = os.Remove(linkPath)
+	require.NoError(t, err)
+	err = os.Symlink(filepath.Join(dir, "yyy"), linkPath)
+	require.NoError(t, err)
+	w.poll()
+
+	require.Len(t, w.Events, 1)
+	ev := <-w.Events
+	require.Equal(t, linkPath, ev.Path)
+	require.Equal(t, Modify, ev.Op)
+}
+
+func TestWatcherCombinedOps(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(time.Hour)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filePath, []byte("modified"), 0644)
+	require.NoError(t, err)
+	err = os.Chmod(filePath, 0600)
+	require.NoError(t, err)
+
+	// both changes land in the next poll
+	err = w.SetInterval(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	ev := nextEvent(t, w)
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Modify|Chmod, ev.Op)
+}
+
+func TestWatcherTypeChange(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithEventBuffer(10))
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+
+	err = os.Remove(filePath)
+	require.NoError(t, err)
+	err = os.Mkdir(filePath, 0755)
+	require.NoError(t, err)
+	w.poll()
+
+	for len(w.Events) > 0 {
+		ev := <-w.Events
+		if ev.Path == filePath {
+			require.Equal(t, Remove|Create, ev.Op)
+			require.True(t, ev.IsDirEvent())
+			return
+		}
+	}
+	t.Fatal("type change not reported")
+}
+
+func TestWatcherSingleFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "a.txt")
+	err := os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithAutoReAdd(), WithEventBuffer(10), WithErrorBuffer(10))
+	defer w.Close()
+
+	err = w.Add(filePath)
+	require.NoError(t, err)
+	require.Len(t, w.Files(), 1)
+
+	writeFile(t, filePath, []byte("modified"), os.O_APPEND)
+	w.poll()
+	ev := <-w.Events
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Modify, ev.Op)
+
+	err = os.Chmod(filePath, 0600)
+	require.NoError(t, err)
+	w.poll()
+	ev = <-w.Events
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Chmod, ev.Op)
+
+	err = os.Remove(filePath)
+	require.NoError(t, err)
+	w.poll()
+	ev = <-w.Events
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Remove, ev.Op)
+	require.Error(t, <-w.Errors)
+
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	w.poll()
+	ev = <-w.Events
+	require.Equal(t, filePath, ev.Path)
+	require.Equal(t, Create, ev.Op)
+	require.Empty(t, w.Events)
+}
+
+func TestWatcherFilterOps(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+	w.FilterOps(Create)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filePath, []byte("modified"), 0644)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	newFilePath := filepath.Join(dir, "yyy")
+	err = os.WriteFile(newFilePath, nil, 0644)
+	require.NoError(t, err)
+	assertEvent(t, w, newFilePath, Create)
+
+	w.ClearFilter()
+	writeFile(t, filePath, []byte(" again"), os.O_APPEND)
+	assertEvent(t, w, filePath, Modify)
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "xxx")
+	err := os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+
+	w := NewWatcher(WithDebounce(100 * time.Millisecond))
+	defer w.Close()
+
+	err = w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		writeFile(t, filePath, []byte("a"), os.O_APPEND)
+		time.Sleep(20 * time.Millisecond)
+	}
+	assertEvent(t, w, filePath, Modify)
+
+	newFilePath := filepath.Join(dir, "yyy")
+	err = os.WriteFile(newFilePath, nil, 0644)
+	require.NoError(t, err)
+	assertEvent(t, w, newFilePath, Create)
+}
+
+func TestWatcherIgnoreHidden(t *testing.T) {
+	dir, _ := os.MkdirTemp("", ".test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher(WithIgnoreHidden())
+	defer w.Close()
+
+	err := w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, ".hidden"), nil, 0644)
+	require.NoError(t, err)
+	err = os.Mkdir(filepath.Join(dir, ".git"), 0755)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	filePath := filepath.Join(dir, "visible")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	assertEvent(t, w, filePath, Create)
+}
+
+func TestWatcherIgnore(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(dir)
+
+	w := NewWatcher()
+	defer w.Close()
+
+	err := w.Ignore("[")
+	require.Error(t, err)
+	err = w.Ignore("*.tmp")
+	require.NoError(t, err)
+	err = w.Add(dir)
+	require.NoError(t, err)
+	err = w.Start(10 * time.Millisecond)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "foo.tmp"), nil, 0644)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	filePath := filepath.Join(dir, "foo.go")
+	err = os.WriteFile(filePath, nil, 0644)
+	require.NoError(t, err)
+	assertEvent(t, w, filePath, Create)
+}
+
+func TestIsUnder(t *testing.T) {
+	sep := string(filepath.Separator)
+	root := filepath.VolumeName(os.TempDir()) + sep
+	foo := filepath.Join(root, "a", "foo")
+
+	for _, tt := range []struct {
+		path, dir string
+		want      bool
+	}{
+		{foo, foo, true},
+		{foo + sep, foo, true},
+		{foo, foo + sep, true},
+		{filepath.Join(foo, "xxx"), foo, true},
+		{filepath.Join(foo, "b", "xxx"), foo + sep, true},
+		{filepath.Join(root, "a", "foobar"), foo, false},
+		{filepath.Join(root, "a", "fo"), foo, false},
+		{filepath.Join(root, "a"), foo, false},
+		{foo, root, true},
+		{root, root, true},
+		{"foo/xxx", "foo", true},
+		{"foobar", "foo", false},
+	} {
+		require.Equal(t, tt.want, isUnder(tt.path, tt.dir), "isUnder(%q, %q)", tt.path, tt.dir)
+	}
+}
+
+func assertEvent(t *testing.T, w *Watcher, path string, op Op) {
+	t.Helper()
+	ev := nextEvent(t, w)
+	require.True(t, ev.HasOps(op))
+	require.Equal(t, path, ev.Path)
+}
+
+// assertNoEvent fails if any event or error arrives within d.
+func assertNoEvent(t *testing.T, w *Watcher, d time.Duration) {
+	t.Helper()
+	select {
+	case ev := <-w.Events:
+		t.Fatalf("unexpected event %s %s", ev.Op, ev.Path)
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(d):
+	}
+}
+
+// nextEvent returns the next event that isn't a directory event.
+func nextEvent(t *testing.T, w *Watcher) Event {
+	t.Helper()
+	for {
+		select {
+		case ev := <-w.Events:
+			if ev.IsDirEvent() {
+				continue
+			}
+			return ev
+		case err := <-w.Errors:
+			t.Fatal(err)
+			return Event{}
+		}
+	}
+}
+
+// slowFS delays listing the slow directory.
+type slowFS struct {
+	fstest.MapFS
+	slow  string
+	delay atomic.Duration
+}
+
+func (f *slowFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == f.slow {
+		time.Sleep(f.delay.Load())
+	}
+	return f.MapFS.ReadDir(name)
+}
+
+// slowOpenFS takes delay to open a file.
+type slowOpenFS struct {
+	fstest.MapFS
+	delay atomic.Duration
+}
+
+func (f *slowOpenFS) Open(name string) (fs.File, error) {
+	time.Sleep(f.delay.Load())
+	return f.MapFS.Open(name)
+}
+
+// flakyFS fails ReadDir as many times as set in fails.
+type flakyFS struct {
+	fstest.MapFS
+	fails atomic.Int32
+}
+
+func (f *flakyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if f.fails.Dec() >= 0 {
+		return nil, errors.New("transient")
+	}
+	return f.MapFS.ReadDir(name)
+}
+
+// chunkFailFS fails reading a directory after a chunk of its entries as
+// many times as set in fails.
+type chunkFailFS struct {
+	fileSystem
+	fails atomic.Int32
+}
+
+func (f *chunkFailFS) ReadDirChunks(name string, _ int, fn func([]fs.DirEntry) error) error {
+	return f.fileSystem.ReadDirChunks(name, 1, func(entries []fs.DirEntry) error {
+		if err := fn(entries); err != nil {
+			return err
+		}
+		if f.fails.Dec() >= 0 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+}
+
+// brokenInfoFS fails Info for the entries named broken.
+type brokenInfoFS struct {
+	fstest.MapFS
+	broken string
+}
+
+func (f brokenInfoFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := f.MapFS.ReadDir(name)
+	for i, entry := range entries {
+		if entry.Name() == f.broken {
+			entries[i] = brokenEntry{entry}
+		}
+	}
+	return entries, err
+}
+
+// brokenStatFS also fails Stat for the entries named broken.
+type brokenStatFS struct {
+	brokenInfoFS
+}
+
+func (f brokenStatFS) Stat(name string) (fs.FileInfo, error) {
+	if path.Base(name) == f.broken {
+		return nil, errors.New("broken")
+	}
+	return f.MapFS.Stat(name)
+}
+
+type brokenEntry struct {
+	fs.DirEntry
+}
+
+func (brokenEntry) Info() (fs.FileInfo, error) {
+	return nil, errors.New("broken")
+}
+
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+type fakeClock struct {
+	c chan time.Time
+
+	mu        sync.Mutex
+	intervals []time.Duration // as passed to NewTicker and Reset
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{c: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.Reset(d)
+	return c
+}
+
+func (c *fakeClock) C() <-chan time.Time {
+	return c.c
+}
+
+func (c *fakeClock) Reset(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.intervals = append(c.intervals, d)
+}
+
+func (c *fakeClock) Stop() {}
+
+// tick triggers a poll of the watcher using c.
+func (c *fakeClock) tick() {
+	c.c <- time.Now()
+}
+
+// writeFile writes data to an existing file without truncating it first,
+// so a poll never observes it shrinking mid-write.
+func writeFile(t *testing.T, path string, data []byte, flag int) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|flag, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write(data)
+	require.NoError(t, err)
+}
+
+func BenchmarkListForAll(b *testing.B) {
+	root, _ := os.MkdirTemp("", "bench")
+	defer os.RemoveAll(root)
+
+	var dirs []string
+	for i := 0; i < 50; i++ {
+		dir := filepath.Join(root, strconv.Itoa(i))
+		err := os.Mkdir(dir, 0755)
+		require.NoError(b, err)
+		for j := 0; j < 200; j++ {
+			err = os.WriteFile(filepath.Join(dir, strconv.Itoa(j)), nil, 0644)
+			require.NoError(b, err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	for _, n := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", n), func(b *testing.B) {
+			w := NewWatcher(WithConcurrency(n))
+			defer w.Close()
+			err := w.AddAll(dirs...)
+			require.NoError(b, err)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.listForAll()
+			}
+		})
+	}
+}
+
+func BenchmarkReadDir(b *testing.B) {
+	dir, _ := os.MkdirTemp("", "bench")
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 20000; i++ {
+		err := os.WriteFile(filepath.Join(dir, strconv.Itoa(i)), nil, 0644)
+		require.NoError(b, err)
+	}
+
+	w := NewWatcher()
+	defer w.Close()
+
+	discard := func([]fs.DirEntry) error {
+		return nil
+	}
+	b.Run("chunked", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := w.readDir(newListing(w.defaultNameOptions()), dir, discard)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("whole", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			entries, err := os.ReadDir(dir)
+			require.NoError(b, err)
+			require.NoError(b, discard(entries))
+		}
+	})
 }